@@ -0,0 +1,48 @@
+package disttest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func TestArtifactSourceFallback(t *testing.T) {
+	env := newEnv(t, &Config{
+		WorkerCount: 3,
+		WorkerLabels: []map[string]string{
+			{"role": "producer"},
+			{"role": "first"},
+			{"role": "second"},
+		},
+	})
+
+	baseJob := build.Job{
+		ID:          build.ID{'a'},
+		Name:        "write",
+		Cmds:        []build.Cmd{{CatTemplate: "OK", CatOutput: "{{.OutputDir}}/out.txt"}},
+		Constraints: []build.Constraint{"role=producer"},
+	}
+
+	consumer := func(id byte, role string) build.Job {
+		return build.Job{
+			ID:          build.ID{id},
+			Name:        "cat",
+			Deps:        []build.ID{{'a'}},
+			Cmds:        []build.Cmd{{Exec: []string{"cat", `{{index .Deps "write"}}/out.txt`}}},
+			Constraints: []build.Constraint{build.Constraint("role=" + role)},
+		}
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{baseJob, consumer('b', "first")}}, recorder))
+	require.Equal(t, &JobResult{Stdout: "OK", Code: new(int)}, recorder.Jobs[build.ID{'b'}])
+
+	// Producer loses the artifact, but the first consumer still has a copy.
+	require.NoError(t, env.WorkerCache[0].Remove(baseJob.ID))
+
+	recorder = NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{baseJob, consumer('c', "second")}}, recorder))
+	require.Equal(t, &JobResult{Stdout: "OK", Code: new(int)}, recorder.Jobs[build.ID{'c'}])
+}
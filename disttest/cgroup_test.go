@@ -0,0 +1,74 @@
+package disttest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+var limitedGraph = build.Graph{
+	Jobs: []build.Job{
+		{
+			ID:   build.ID{'a'},
+			Name: "limited",
+			Cmds: []build.Cmd{
+				{Exec: []string{"echo", "OK"}},
+			},
+			Resources: build.Resources{MilliCPU: 500, Memory: 64 << 20, Pids: 16},
+		},
+	},
+}
+
+func TestCgroupFallback(t *testing.T) {
+	env := newEnv(t, &Config{
+		WorkerCount: 1,
+		Worker:      worker.Config{Cgroup: &worker.CgroupConfig{Root: t.TempDir()}},
+	})
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, limitedGraph, recorder))
+
+	assert.Equal(t, &JobResult{Stdout: "OK\n", Code: new(int)}, recorder.Jobs[build.ID{'a'}])
+}
+
+// TestCgroupMemoryLimit запускается только с делегированной cgroup v2, например:
+//
+//	DISTBUILD_TEST_CGROUP=/sys/fs/cgroup/distbuild go test ./disttest -run Cgroup
+func TestCgroupMemoryLimit(t *testing.T) {
+	root := os.Getenv("DISTBUILD_TEST_CGROUP")
+	if root == "" {
+		t.Skip("DISTBUILD_TEST_CGROUP is not set")
+	}
+
+	env := newEnv(t, &Config{
+		WorkerCount: 1,
+		Worker:      worker.Config{Cgroup: &worker.CgroupConfig{Root: root}},
+	})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "oom",
+				Cmds: []build.Cmd{
+					{Exec: []string{"tail", "/dev/zero"}},
+				},
+				Resources: build.Resources{Memory: 32 << 20},
+				Timeout:   5 * time.Second,
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	job := recorder.Jobs[build.ID{'a'}]
+	require.NotNil(t, job)
+	require.Contains(t, job.Error, "memory limit")
+}
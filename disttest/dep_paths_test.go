@@ -0,0 +1,49 @@
+package disttest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func TestSelectiveDepTransfer(t *testing.T) {
+	env := newEnv(t, &Config{
+		WorkerCount:  2,
+		WorkerLabels: []map[string]string{{"role": "producer"}, {"role": "consumer"}},
+	})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "produce",
+				Cmds: []build.Cmd{
+					{CatTemplate: "a", CatOutput: "{{.OutputDir}}/lib/a.a"},
+					{CatTemplate: "b", CatOutput: "{{.OutputDir}}/lib/b.a"},
+					{CatTemplate: "h", CatOutput: "{{.OutputDir}}/include/a.h"},
+					{CatTemplate: "big", CatOutput: "{{.OutputDir}}/big.bin"},
+				},
+				Constraints: []build.Constraint{"role=producer"},
+			},
+			{
+				ID:          build.ID{'b'},
+				Name:        "consume",
+				Deps:        []build.ID{{'a'}},
+				DepPaths:    map[build.ID][]string{{'a'}: {"lib/a.a", "include"}},
+				Constraints: []build.Constraint{"role=consumer"},
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", `cd {{index .Deps "produce"}} && find . -type f | sort`}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Equal(t, &JobResult{Stdout: "./include/a.h\n./lib/a.a\n", Code: new(int)}, recorder.Jobs[build.ID{'b'}])
+
+	_, _, err := env.WorkerCache[1].Get(build.ID{'a'})
+	require.Error(t, err, "partial artifact must not enter the cache")
+}
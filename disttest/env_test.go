@@ -0,0 +1,80 @@
+package disttest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+func TestHermeticEnviron(t *testing.T) {
+	t.Setenv("DISTBUILD_SECRET", "secret")
+	t.Setenv("DISTBUILD_SHARED", "shared")
+
+	env := newEnv(t, &Config{
+		WorkerCount: 1,
+		Worker:      worker.Config{EnvPassthrough: []string{"DISTBUILD_SHARED"}},
+	})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "env",
+				Cmds: []build.Cmd{
+					{Exec: []string{"env"}, Environ: []string{"OUT={{.OutputDir}}/out.txt", "HOME=/home"}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	result := recorder.Jobs[build.ID{'a'}]
+	require.Equal(t, new(int), result.Code)
+
+	vars := map[string]string{}
+	var names []string
+	for _, kv := range strings.Split(strings.TrimSpace(result.Stdout), "\n") {
+		name, value, _ := strings.Cut(kv, "=")
+		vars[name] = value
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	require.Equal(t, []string{"DISTBUILD_SHARED", "HOME", "OUT", "PATH", "TMPDIR"}, names)
+	require.Equal(t, "shared", vars["DISTBUILD_SHARED"])
+	require.Equal(t, "/home", vars["HOME"])
+	require.True(t, strings.HasSuffix(vars["OUT"], "/out.txt"))
+	require.NotContains(t, vars["OUT"], "{{")
+	require.NotEmpty(t, vars["TMPDIR"])
+}
+
+func TestWorkingDirectory(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 1})
+
+	samedir := []string{"sh", "-c", `[ "$(pwd -P)" = "$(cd "$1" && pwd -P)" ] && echo OK`, "sh"}
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "workdir",
+				Cmds: []build.Cmd{
+					{Exec: append(samedir, "{{.SourceDir}}")},
+					{MkdirPath: "{{.OutputDir}}/sub"},
+					{Exec: append(samedir, "{{.OutputDir}}/sub"), WorkingDirectory: "{{.OutputDir}}/sub"},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Equal(t, &JobResult{Stdout: "OK\nOK\n", Code: new(int)}, recorder.Jobs[build.ID{'a'}])
+}
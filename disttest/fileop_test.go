@@ -0,0 +1,93 @@
+package disttest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func testFileOpsConfined(t *testing.T, env *env) {
+	victimDir := t.TempDir()
+	victim := filepath.Join(victimDir, "victim")
+	require.NoError(t, os.WriteFile(victim, []byte("keep"), 0666))
+
+	for _, tc := range []struct {
+		name string
+		cmds []build.Cmd
+	}{
+		{
+			name: "remove outside",
+			cmds: []build.Cmd{{RemovePath: victim}},
+		},
+		{
+			name: "cat through dot dot",
+			cmds: []build.Cmd{{CatTemplate: "pwned", CatOutput: "{{.OutputDir}}" + strings.Repeat("/..", 32) + victim}},
+		},
+		{
+			name: "cat through symlink",
+			cmds: []build.Cmd{
+				{SymlinkTarget: victimDir, SymlinkOutput: "{{.OutputDir}}/link"},
+				{CatTemplate: "pwned", CatOutput: "{{.OutputDir}}/link/victim"},
+			},
+		},
+		{
+			name: "copy from outside",
+			cmds: []build.Cmd{{CopySource: victim, CopyOutput: "{{.OutputDir}}/stolen"}},
+		},
+		{
+			name: "remove output dir",
+			cmds: []build.Cmd{{RemovePath: "{{.OutputDir}}"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			job := build.Job{ID: build.NewID(), Name: "escape", Cmds: tc.cmds}
+
+			recorder := NewRecorder()
+			require.Error(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{job}}, recorder))
+			require.Contains(t, recorder.Jobs, job.ID)
+			assert.Contains(t, recorder.Jobs[job.ID].Error, "outside of the job directories")
+
+			content, err := os.ReadFile(victim)
+			require.NoError(t, err)
+			require.Equal(t, "keep", string(content))
+		})
+	}
+
+	job := build.Job{
+		ID:   build.NewID(),
+		Name: "inside",
+		Cmds: []build.Cmd{
+			{MkdirPath: "{{.OutputDir}}/dir"},
+			{CatTemplate: "OK\n", CatOutput: "{{.TmpDir}}/sub/tmp.txt"},
+			{CopySource: "{{.SourceDir}}/a.txt", CopyOutput: "{{.OutputDir}}/dir/a.txt"},
+			{SymlinkTarget: "dir/a.txt", SymlinkOutput: "{{.OutputDir}}/link"},
+			{CatTemplate: "gone", CatOutput: "{{.OutputDir}}/dir/../removed.txt"},
+			{RemovePath: "{{.OutputDir}}/removed.txt"},
+			{Exec: []string{"sh", "-c", "cat {{.OutputDir}}/link {{.TmpDir}}/sub/tmp.txt; ls {{.OutputDir}}"}},
+		},
+		Inputs: []string{"a.txt"},
+	}
+
+	graph := build.Graph{
+		SourceFiles: map[build.ID]string{{'a'}: "a.txt"},
+		Jobs:        []build.Job{job},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	assert.Equal(t, &JobResult{Stdout: "A\nOK\ndir\nlink\n", Code: new(int)}, recorder.Jobs[job.ID])
+}
+
+func TestFileOpsConfined(t *testing.T) {
+	testFileOpsConfined(t, newEnv(t, &Config{WorkerCount: 1}))
+}
+
+func TestSandboxFileOpsConfined(t *testing.T) {
+	testFileOpsConfined(t, newSandboxEnv(t))
+}
@@ -47,6 +47,15 @@ const (
 
 type Config struct {
 	WorkerCount int
+
+	// Coordinator задаёт настройки координатора. Если nil, используется dist.DefaultConfig.
+	Coordinator *dist.Config
+
+	// Worker задаёт настройки всех воркеров.
+	Worker worker.Config
+
+	// WorkerLabels задаёт метки воркеров по их номерам, переопределяя Worker.Labels.
+	WorkerLabels []map[string]string
 }
 
 func newEnv(t *testing.T, config *Config) (e *env) {
@@ -117,9 +126,15 @@ func newEnv(t *testing.T, config *Config) (e *env) {
 	coordinatorCache, err := filecache.New(filepath.Join(env.RootDir, "coordinator", "filecache"))
 	require.NoError(t, err)
 
-	env.Coordinator = dist.NewCoordinator(
+	coordinatorConfig := dist.DefaultConfig
+	if config.Coordinator != nil {
+		coordinatorConfig = *config.Coordinator
+	}
+
+	env.Coordinator = dist.NewCoordinatorWithConfig(
 		env.Logger.Named("coordinator"),
 		coordinatorCache,
+		coordinatorConfig,
 	)
 	t.Cleanup(env.Coordinator.Stop)
 
@@ -141,12 +156,21 @@ func newEnv(t *testing.T, config *Config) (e *env) {
 		workerPrefix := fmt.Sprintf("/worker/%d", i)
 		workerID := api.WorkerID("http://" + addr + workerPrefix)
 
-		w := worker.New(
+		workerConfig := config.Worker
+		if i < len(config.WorkerLabels) {
+			workerConfig.Labels = config.WorkerLabels[i]
+		}
+		if workerConfig.LogDir == "" {
+			workerConfig.LogDir = filepath.Join(workerDir, "logs")
+		}
+
+		w := worker.NewWithConfig(
 			workerID,
 			coordinatorEndpoint,
 			env.Logger.Named(workerName),
 			fileCache,
 			artifacts,
+			workerConfig,
 		)
 
 		env.Workers = append(env.Workers, w)
@@ -0,0 +1,58 @@
+package disttest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func TestWorkerSurvivesJobFailures(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 1})
+
+	for _, tc := range []struct {
+		name  string
+		cmd   build.Cmd
+		error string
+	}{
+		{
+			name:  "missing executable",
+			cmd:   build.Cmd{Exec: []string{"/no/such/binary"}},
+			error: "run cmd 0",
+		},
+		{
+			name:  "render error",
+			cmd:   build.Cmd{Exec: []string{"echo", "{{.NoSuchField}}"}},
+			error: "render cmd 0",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			job := build.Job{
+				ID:   build.NewID(),
+				Name: "broken",
+				Cmds: []build.Cmd{tc.cmd},
+			}
+
+			recorder := NewRecorder()
+			err := env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{job}}, recorder)
+			assert.ErrorContains(t, err, "job "+job.ID.String())
+			require.Contains(t, recorder.Jobs, job.ID)
+			assert.Contains(t, recorder.Jobs[job.ID].Error, tc.error)
+
+			_, _, err = env.WorkerCache[0].Get(job.ID)
+			assert.Error(t, err, "artifact of failed job must be aborted")
+		})
+	}
+
+	echoJob := build.Job{
+		ID:   build.ID{'e'},
+		Name: "echo",
+		Cmds: []build.Cmd{{Exec: []string{"echo", "OK"}}},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{echoJob}}, recorder))
+	assert.Equal(t, &JobResult{Stdout: "OK\n", Code: new(int)}, recorder.Jobs[echoJob.ID])
+}
@@ -0,0 +1,42 @@
+package disttest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+func TestJobConstraints(t *testing.T) {
+	env := newEnv(t, &Config{
+		WorkerCount: 1,
+		Worker:      worker.Config{Labels: map[string]string{"gcc": "12"}},
+	})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:          build.ID{'a'},
+				Name:        "echo",
+				Cmds:        []build.Cmd{{Exec: []string{"echo", "OK"}}},
+				Constraints: []build.Constraint{"gcc=12"},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	assert.Equal(t, &JobResult{Stdout: "OK\n", Code: new(int)}, recorder.Jobs[build.ID{'a'}])
+
+	graph.Jobs[0].ID = build.ID{'b'}
+	graph.Jobs[0].Constraints = []build.Constraint{"gcc=13"}
+
+	recorder = NewRecorder()
+	err := env.Client.Build(env.Ctx, graph, recorder)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "can't run on any of 1 registered workers")
+	require.Empty(t, recorder.Jobs)
+}
@@ -0,0 +1,219 @@
+package disttest
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+// streamRecorder remembers the order, in which job output arrives.
+type streamRecorder struct {
+	*Recorder
+	events []string
+}
+
+func (r *streamRecorder) OnJobStdout(jobID build.ID, stdout []byte) error {
+	r.events = append(r.events, string(stdout))
+	return r.Recorder.OnJobStdout(jobID, stdout)
+}
+
+func (r *streamRecorder) OnJobFinished(jobID build.ID) error {
+	r.events = append(r.events, "finished")
+	return r.Recorder.OnJobFinished(jobID)
+}
+
+func TestStreamJobOutput(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 1})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "slow",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", "echo started; sleep 1; echo done"}},
+				},
+			},
+		},
+	}
+
+	recorder := &streamRecorder{Recorder: NewRecorder()}
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	require.Equal(t, []string{"started\n", "done\n", "finished"}, recorder.events)
+	require.Equal(t, &JobResult{Stdout: "started\ndone\n", Code: new(int)}, recorder.Jobs[build.ID{'a'}])
+}
+
+// truncatedRecorder remembers references to the full output of jobs.
+type truncatedRecorder struct {
+	*Recorder
+	stdout, stderr map[build.ID]*api.LogRef
+}
+
+func (r *truncatedRecorder) OnJobOutputTruncated(jobID build.ID, stdout, stderr *api.LogRef) error {
+	r.stdout[jobID] = stdout
+	r.stderr[jobID] = stderr
+	return nil
+}
+
+func TestTruncateJobOutput(t *testing.T) {
+	env := newEnv(t, &Config{
+		WorkerCount: 1,
+		Worker:      worker.Config{MaxInlineOutput: 16},
+	})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "seq",
+				Cmds: []build.Cmd{
+					{Exec: []string{"seq", "1000"}},
+					{Exec: []string{"sh", "-c", "echo short >&2"}},
+				},
+			},
+		},
+	}
+
+	var full strings.Builder
+	for i := 1; i <= 1000; i++ {
+		fmt.Fprintf(&full, "%d\n", i)
+	}
+
+	recorder := &truncatedRecorder{
+		Recorder: NewRecorder(),
+		stdout:   map[build.ID]*api.LogRef{},
+		stderr:   map[build.ID]*api.LogRef{},
+	}
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	// Output is streamed in full, only JobResult keeps the inline part.
+	require.Equal(t, full.String(), recorder.Jobs[build.ID{'a'}].Stdout)
+	require.Equal(t, "short\n", recorder.Jobs[build.ID{'a'}].Stderr)
+
+	ref := recorder.stdout[build.ID{'a'}]
+	require.NotNil(t, ref)
+	require.Equal(t, int64(full.Len()), ref.Size)
+	require.Nil(t, recorder.stderr[build.ID{'a'}])
+
+	log, err := env.Client.FetchLog(env.Ctx, ref)
+	require.NoError(t, err)
+	defer log.Close()
+
+	content, err := io.ReadAll(log)
+	require.NoError(t, err)
+	require.Equal(t, full.String(), string(content))
+}
+
+func TestLargeStderrDoesNotBlockStdout(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 1})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "noisy",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", "head -c 1000000 /dev/zero >&2; echo done"}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	result := recorder.Jobs[build.ID{'a'}]
+	require.Equal(t, "done\n", result.Stdout)
+	require.Len(t, result.Stderr, 1000000)
+	require.Equal(t, new(int), result.Code)
+}
+
+// logRecorder remembers combined logs of jobs.
+type logRecorder struct {
+	*Recorder
+	logs      map[build.ID][]api.LogLine
+	truncated map[build.ID]bool
+}
+
+func newLogRecorder() *logRecorder {
+	return &logRecorder{
+		Recorder:  NewRecorder(),
+		logs:      make(map[build.ID][]api.LogLine),
+		truncated: make(map[build.ID]bool),
+	}
+}
+
+func (r *logRecorder) OnJobLog(jobID build.ID, log []api.LogLine, truncated bool) error {
+	r.logs[jobID] = log
+	r.truncated[jobID] = truncated
+	return nil
+}
+
+func TestCombinedJobLog(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 1})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "mixed",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", "echo a; sleep 0.1; echo b >&2; sleep 0.1; echo c"}},
+					{Exec: []string{"sh", "-c", "printf d >&2"}},
+				},
+				CombinedLog: true,
+			},
+		},
+	}
+
+	recorder := newLogRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	log := recorder.logs[build.ID{'a'}]
+	var lines []string
+	for i, line := range log {
+		lines = append(lines, line.Stream+": "+line.Text)
+		if i > 0 {
+			require.False(t, line.Time.Before(log[i-1].Time))
+		}
+	}
+	require.Equal(t, []string{"stdout: a", "stderr: b", "stdout: c", "stderr: d"}, lines)
+	require.Equal(t, "a\nc\n", recorder.Jobs[build.ID{'a'}].Stdout)
+}
+
+func TestCombinedJobLogTruncatesNewlines(t *testing.T) {
+	env := newEnv(t, &Config{
+		WorkerCount: 1,
+		Worker:      worker.Config{MaxInlineOutput: 16},
+	})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "blank",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", "echo a; head -c 1000000 /dev/zero | tr '\\0' '\\n'"}},
+				},
+				CombinedLog: true,
+			},
+		},
+	}
+
+	recorder := newLogRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	require.True(t, recorder.truncated[build.ID{'a'}])
+	log := recorder.logs[build.ID{'a'}]
+	require.Len(t, log, 15)
+	require.Equal(t, "a", log[0].Text)
+	require.Equal(t, "", log[14].Text)
+}
@@ -0,0 +1,54 @@
+package disttest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func TestDeclaredOutputs(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 1})
+
+	forgetful := build.Job{
+		ID:      build.ID{'a'},
+		Name:    "forgetful",
+		Outputs: []string{"lib.a", "*.h"},
+		Cmds: []build.Cmd{
+			{CatTemplate: "lib", CatOutput: "{{.OutputDir}}/lib.a"},
+		},
+	}
+
+	recorder := NewRecorder()
+	err := env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{forgetful}}, recorder)
+	require.ErrorContains(t, err, "forgetful")
+	require.Contains(t, recorder.Jobs[forgetful.ID].Error, "job did not produce declared outputs: *.h")
+
+	strict := build.Job{
+		ID:            build.ID{'b'},
+		Name:          "strict",
+		Outputs:       []string{"out.txt"},
+		StrictOutputs: true,
+		Cmds: []build.Cmd{
+			{CatTemplate: "OK", CatOutput: "{{.OutputDir}}/out.txt"},
+			{CatTemplate: "junk", CatOutput: "{{.OutputDir}}/junk.txt"},
+		},
+	}
+
+	strictRecorder := &undeclaredRecorder{Recorder: NewRecorder(), outputs: make(map[build.ID][]string)}
+	require.NoError(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{strict}}, strictRecorder))
+	require.Equal(t, &JobResult{Code: new(int)}, strictRecorder.Jobs[strict.ID])
+	require.Equal(t, map[build.ID][]string{strict.ID: {"junk.txt"}}, strictRecorder.outputs)
+}
+
+// undeclaredRecorder remembers undeclared outputs of jobs.
+type undeclaredRecorder struct {
+	*Recorder
+	outputs map[build.ID][]string
+}
+
+func (r *undeclaredRecorder) OnJobUndeclaredOutputs(jobID build.ID, outputs []string) error {
+	r.outputs[jobID] = outputs
+	return nil
+}
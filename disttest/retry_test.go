@@ -0,0 +1,85 @@
+package disttest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func TestRetryInfrastructureFailure(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 2})
+
+	// The first worker can't create artifacts, so every job it picks fails with retryable error.
+	tmpDir := filepath.Join(env.RootDir, "worker0", "artifacts", "tmp")
+	require.NoError(t, os.RemoveAll(tmpDir))
+	require.NoError(t, os.WriteFile(tmpDir, nil, 0666))
+
+	var graph build.Graph
+	for i := 0; i < 4; i++ {
+		graph.Jobs = append(graph.Jobs, build.Job{
+			ID:   build.ID{'a', byte(i)},
+			Name: "where",
+			Cmds: []build.Cmd{{Exec: []string{"echo", "{{.WorkerID}}"}}},
+		})
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	for _, job := range graph.Jobs {
+		result := recorder.Jobs[job.ID]
+		require.NotNil(t, result)
+		assert.Equal(t, new(int), result.Code)
+		assert.Regexp(t, "/worker/1\n$", result.Stdout, "jobs must be retried on the healthy worker")
+	}
+}
+
+func TestRetryInfrastructureFailureExhausted(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 1})
+
+	baseJob := build.Job{
+		ID:   build.ID{'a'},
+		Name: "write",
+		Cmds: []build.Cmd{
+			{CatTemplate: "OK", CatOutput: "{{.OutputDir}}/out.txt"},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{baseJob}}, recorder))
+
+	// Coordinator still believes that the worker has the artifact, so the dependent job
+	// fails to download it on every attempt.
+	require.NoError(t, env.WorkerCache[0].Remove(baseJob.ID))
+
+	depJob := build.Job{
+		ID:   build.ID{'b'},
+		Name: "cat",
+		Cmds: []build.Cmd{
+			{Exec: []string{"cat", "{{index .Deps \"" + baseJob.ID.String() + "\"}}/out.txt"}},
+		},
+		Deps: []build.ID{baseJob.ID},
+	}
+
+	recorder = NewRecorder()
+	err := env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{baseJob, depJob}}, recorder)
+	require.ErrorContains(t, err, "job "+depJob.ID.String())
+	require.Contains(t, recorder.Jobs, depJob.ID)
+	assert.Contains(t, recorder.Jobs[depJob.ID].Error, "status code is not OK")
+
+	// The worker survives the failure and keeps running jobs.
+	echoJob := build.Job{
+		ID:   build.ID{'c'},
+		Name: "echo",
+		Cmds: []build.Cmd{{Exec: []string{"echo", "OK"}}},
+	}
+
+	recorder = NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{echoJob}}, recorder))
+	assert.Equal(t, &JobResult{Stdout: "OK\n", Code: new(int)}, recorder.Jobs[echoJob.ID])
+}
@@ -0,0 +1,97 @@
+package disttest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+func newSandboxEnv(t *testing.T) *env {
+	if runtime.GOOS != "linux" {
+		t.Skip("sandbox is supported only on linux")
+	}
+
+	if n, err := os.ReadFile("/proc/sys/user/max_user_namespaces"); err == nil && strings.TrimSpace(string(n)) == "0" {
+		t.Skip("user namespaces are disabled")
+	}
+
+	return newEnv(t, &Config{
+		WorkerCount: 1,
+		Worker:      worker.Config{Sandbox: &worker.DefaultSandboxConfig},
+	})
+}
+
+func TestSandboxHermeticTmp(t *testing.T) {
+	env := newSandboxEnv(t)
+
+	hostFile := filepath.Join(os.TempDir(), fmt.Sprintf("distbuild-sandbox-%d", os.Getpid()))
+	t.Cleanup(func() { _ = os.Remove(hostFile) })
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "tmp",
+				Cmds: []build.Cmd{
+					{Exec: []string{"bash", "-c", "echo -n OK > " + hostFile + " && cat " + hostFile}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	assert.Equal(t, &JobResult{Stdout: "OK", Code: new(int)}, recorder.Jobs[build.ID{'a'}])
+
+	_, err := os.Stat(hostFile)
+	require.True(t, os.IsNotExist(err), "sandbox must not write to host /tmp")
+}
+
+func TestSandboxMounts(t *testing.T) {
+	env := newSandboxEnv(t)
+
+	graph := build.Graph{
+		SourceFiles: map[build.ID]string{
+			{'a'}: "a.txt",
+		},
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "write",
+				Cmds: []build.Cmd{
+					{Exec: []string{"bash", "-c", "cat {{.SourceDir}}/a.txt > {{.OutputDir}}/out.txt"}},
+				},
+				Inputs: []string{"a.txt"},
+			},
+			{
+				ID:   build.ID{'b'},
+				Name: "check",
+				Cmds: []build.Cmd{
+					{Exec: []string{"cat", fmt.Sprintf("{{index .Deps %q}}/out.txt", build.ID{'a'})}},
+					{Exec: []string{"bash", "-c", strings.Join([]string{
+						fmt.Sprintf("touch {{index .Deps %q}}/x 2>/dev/null && echo dep-writable", build.ID{'a'}),
+						"touch {{.SourceDir}}/x 2>/dev/null && echo source-writable",
+						"test -e " + filepath.Join(env.RootDir, "test.log") + " && echo host-visible",
+						"true",
+					}, "; ")}},
+				},
+				Deps: []build.ID{{'a'}},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	assert.Equal(t, &JobResult{Stdout: "foo", Code: new(int)}, recorder.Jobs[build.ID{'b'}])
+}
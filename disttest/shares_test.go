@@ -0,0 +1,59 @@
+package disttest
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+)
+
+func getShares(t *testing.T, env *env) []scheduler.BuildShare {
+	rsp, err := http.Get("http://" + env.HTTP.Addr + "/coordinator/shares")
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	var shares []scheduler.BuildShare
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&shares))
+	return shares
+}
+
+func TestBuildShares(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 1})
+	env.Client.SetUser("alice", "ci")
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "sleep",
+				Cmds: []build.Cmd{{Exec: []string{"sleep", "1"}}},
+			},
+		},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- env.Client.Build(env.Ctx, graph, NewRecorder())
+	}()
+
+	require.Eventually(t, func() bool {
+		shares := getShares(t, env)
+		return len(shares) == 1 && shares[0].Picked == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	shares := getShares(t, env)
+	assert.Equal(t, "alice", shares[0].User)
+	assert.Equal(t, "ci", shares[0].Class)
+	assert.Equal(t, 1.0, shares[0].Share)
+
+	require.NoError(t, <-done)
+	require.Empty(t, getShares(t, env))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -48,7 +49,7 @@ func TestJobCaching(t *testing.T) {
 				ID:   build.ID{'a'},
 				Name: "echo",
 				Cmds: []build.Cmd{
-					{CatTemplate: "OK\n", CatOutput: tmpFile.Name()}, // No-hermetic, for testing purposes.
+					{Exec: []string{"sh", "-c", "echo OK > " + tmpFile.Name()}}, // No-hermetic, for testing purposes.
 					{Exec: []string{"echo", "OK"}},
 				},
 			},
@@ -71,6 +72,42 @@ func TestJobCaching(t *testing.T) {
 	require.Equal(t, []byte("NOTOK\n"), output)
 }
 
+func TestJobArtifactAlreadyCached(t *testing.T) {
+	env := newEnv(t, singleWorkerConfig)
+
+	dir, commit, _, err := env.WorkerCache[0].Create(build.ID{'a'})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "out.txt"), []byte("cached"), 0666))
+	require.NoError(t, commit())
+
+	tmpFile, err := os.CreateTemp("", "")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(tmpFile.Name()) }()
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "echo",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", "echo OK > " + tmpFile.Name()}}, // No-hermetic, for testing purposes.
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	assert.Len(t, recorder.Jobs, 1)
+	assert.Equal(t, &JobResult{Code: new(int)}, recorder.Jobs[build.ID{'a'}])
+
+	// The job is not run again, its artifact from the cache is used.
+	output, err := io.ReadAll(tmpFile)
+	require.NoError(t, err)
+	require.Empty(t, output)
+}
+
 var sourceFilesGraph = build.Graph{
 	SourceFiles: map[build.ID]string{
 		{'a'}: "a.txt",
@@ -131,3 +168,24 @@ func TestArtifactTransferBetweenJobs(t *testing.T) {
 	assert.Len(t, recorder.Jobs, 2)
 	assert.Equal(t, &JobResult{Stdout: "OK", Code: new(int)}, recorder.Jobs[build.ID{'b'}])
 }
+
+func TestInvalidGraph(t *testing.T) {
+	env := newEnv(t, singleWorkerConfig)
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "cycle",
+				Cmds: []build.Cmd{{Exec: []string{"echo", "OK"}}},
+				Deps: []build.ID{{'a'}},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	err := env.Client.Build(env.Ctx, graph, recorder)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dependency cycle")
+	require.Empty(t, recorder.Jobs)
+}
@@ -0,0 +1,72 @@
+package disttest
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/dist"
+)
+
+func TestSpeculativeExecution(t *testing.T) {
+	coordinatorConfig := dist.DefaultConfig
+	coordinatorConfig.Speculation = &dist.SpeculationConfig{
+		Slowdown:    2,
+		MinDuration: 200 * time.Millisecond,
+	}
+
+	env := newEnv(t, &Config{WorkerCount: 2, Coordinator: &coordinatorConfig})
+
+	// Fill the history, so that the coordinator knows how long the job usually runs.
+	for i := 0; i < 3; i++ {
+		job := build.Job{
+			ID:   build.NewID(),
+			Name: "straggler",
+			Cmds: []build.Cmd{{Exec: []string{"echo", "OK"}}},
+		}
+		require.NoError(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{job}}, NewRecorder()))
+	}
+
+	// The first attempt creates the marker, prints its output and gets stuck, the speculative copy
+	// finishes immediately.
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "marker")
+	pidFile := filepath.Join(dir, "pid")
+	job := build.Job{
+		ID:   build.NewID(),
+		Name: "straggler",
+		Cmds: []build.Cmd{
+			{Exec: []string{"sh", "-c", "if mkdir " + marker + " 2>/dev/null; then echo $$ > " + pidFile + "; sleep 5; fi; echo OK"}},
+		},
+	}
+
+	start := time.Now()
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{job}}, recorder))
+
+	assert.Less(t, time.Since(start), 3*time.Second)
+	// Output of the slow attempt may be already streamed, but the client still gets the whole output
+	// of the copy that won.
+	result := recorder.Jobs[job.ID]
+	require.NotNil(t, result)
+	assert.Contains(t, []string{"OK\n", "slow\nOK\n"}, result.Stdout)
+	assert.Equal(t, new(int), result.Code)
+
+	// The slow attempt is canceled through the heartbeat of its worker.
+	content, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return syscall.Kill(pid, 0) == syscall.ESRCH
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,42 @@
+package disttest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func TestTemplateDepNames(t *testing.T) {
+	env := newEnv(t, &Config{WorkerCount: 1})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "write",
+				Cmds: []build.Cmd{
+					{CatTemplate: "OK", CatOutput: "{{.OutputDir}}/out.txt"},
+				},
+			},
+			{
+				ID:         build.ID{'b'},
+				Name:       "cat",
+				Deps:       []build.ID{{'a'}},
+				DepAliases: map[string]build.ID{"base": {'a'}},
+				Cmds: []build.Cmd{
+					{Exec: []string{"cat", `{{index .Deps "write"}}/out.txt`, `{{index .Deps "base"}}/out.txt`}},
+					{Exec: []string{"sh", "-c", `[ -d {{quote .TmpDir}} ] && [ {{.NumCPU}} -gt 0 ] && echo {{basename .OutputDir}}`}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	result := recorder.Jobs[build.ID{'b'}]
+	require.Equal(t, new(int), result.Code)
+	require.Equal(t, "OKOK"+build.ID{'b'}.String()+"\n", result.Stdout)
+}
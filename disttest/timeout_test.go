@@ -0,0 +1,65 @@
+package disttest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/dist"
+)
+
+func TestCmdTimeout(t *testing.T) {
+	env := newEnv(t, singleWorkerConfig)
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "hang",
+				Cmds: []build.Cmd{
+					{Exec: []string{"echo", "started"}},
+					{Exec: []string{"bash", "-c", "sleep 10 & sleep 10"}, Timeout: 100 * time.Millisecond},
+				},
+			},
+		},
+	}
+
+	start := time.Now()
+	recorder := NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	job := recorder.Jobs[build.ID{'a'}]
+	require.NotNil(t, job)
+	require.Equal(t, "started\n", job.Stdout)
+	require.NotNil(t, job.Code)
+	require.NotEqual(t, 0, *job.Code)
+	require.Contains(t, job.Error, "cmd 1 timed out")
+}
+
+func TestDefaultJobTimeout(t *testing.T) {
+	config := dist.DefaultConfig
+	config.DefaultJobTimeout = 100 * time.Millisecond
+	env := newEnv(t, &Config{WorkerCount: 1, Coordinator: &config})
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "hang",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sleep", "10"}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	job := recorder.Jobs[build.ID{'a'}]
+	require.NotNil(t, job)
+	require.Contains(t, job.Error, "job timed out after 100ms")
+}
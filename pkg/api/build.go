@@ -8,6 +8,17 @@ import (
 
 type BuildRequest struct {
 	Graph build.Graph
+
+	// Priority задаёт приоритет сборки. Джобы сборки с большим приоритетом выдаются воркерам раньше.
+	//
+	// Например, интерактивным сборкам можно выставлять приоритет выше, чем сборкам в CI.
+	Priority int
+
+	// User и Class определяют вес сборки при честном разделении воркеров между одновременными сборками.
+	//
+	// Веса задаются в scheduler.Config. Пустые значения получают вес по умолчанию.
+	User  string
+	Class string
 }
 
 type BuildStarted struct {
@@ -16,6 +27,12 @@ type BuildStarted struct {
 }
 
 type StatusUpdate struct {
+	// JobOutput содержит вывод джоба, который ещё выполняется.
+	//
+	// JobResult из JobFinished содержит только ту часть вывода джоба, которая не была прислана в JobOutput.
+	// Если джоб завершила другая попытка, чем та, чей вывод пересылался, JobFinished содержит её полный вывод.
+	JobOutput *JobOutput
+
 	JobFinished   *JobResult
 	BuildFailed   *BuildFailed
 	BuildFinished *BuildFinished
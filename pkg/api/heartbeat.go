@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"time"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 )
@@ -12,12 +13,90 @@ type JobResult struct {
 
 	Stdout, Stderr []byte
 
+	// StdoutLog и StderrLog ссылаются на полный вывод джоба, если он не поместился в Stdout и Stderr.
+	//
+	// В этом случае Stdout и Stderr содержат только начало вывода.
+	StdoutLog, StderrLog *LogRef
+
+	// Log содержит строки stdout и stderr всех команд в порядке появления, если джоб
+	// запрошен с build.Job.CombinedLog.
+	//
+	// Размер журнала ограничен так же, как размер Stdout и Stderr. LogTruncated сообщает,
+	// что строки, не поместившиеся в ограничение, отброшены.
+	Log          []LogLine
+	LogTruncated bool
+
+	// UndeclaredOutputs перечисляет файлы выходной директории, не покрытые build.Job.Outputs.
+	// Заполняется только для джобов с build.Job.StrictOutputs.
+	UndeclaredOutputs []string
+
 	ExitCode int
 
 	// Error описывает сообщение об ошибке, из-за которого джоб не удалось выполнить.
 	//
 	// Если Error == nil, значит джоб завершился успешно.
 	Error *string
+
+	// TimedOut сообщает, что джоб был остановлен, потому что превысил Job.Timeout или Cmd.Timeout.
+	//
+	// В этом случае Error тоже заполнен.
+	TimedOut bool
+
+	// Retryable сообщает, что джоб не выполнился из-за сбоя инфраструктуры, а не из-за команды джоба.
+	// Например, воркер не смог скачать исходные файлы или артефакты зависимостей.
+	//
+	// Такой джоб координатор перезапускает, по возможности на другом воркере. Error тоже заполнен.
+	Retryable bool
+
+	// Usage описывает ресурсы, потраченные всеми командами джоба.
+	Usage ResourceUsage
+}
+
+// LogLine описывает строку вывода команды джоба.
+type LogLine struct {
+	// Time задаёт момент, когда воркер получил начало строки.
+	Time time.Time
+
+	// Stream равен "stdout" или "stderr".
+	Stream string
+
+	// Text содержит строку без завершающего перевода строки.
+	Text string
+}
+
+// LogRef ссылается на полный вывод джоба, сохранённый на воркере.
+type LogRef struct {
+	// Worker задаёт воркер, с которого можно скачать лог.
+	Worker WorkerID
+
+	Job build.ID
+
+	// Stream равен "stdout" или "stderr".
+	Stream string
+
+	// Size задаёт полный размер вывода в байтах.
+	Size int64
+}
+
+// ResourceUsage описывает потребление ресурсов джобом.
+type ResourceUsage struct {
+	// PeakRSS задаёт максимальный объём занятой памяти в байтах.
+	PeakRSS int64
+
+	// CPUTime задаёт суммарное процессорное время в пространстве пользователя и ядра.
+	CPUTime time.Duration
+
+	// WallTime задаёт время от запуска первой команды джоба до завершения последней.
+	WallTime time.Duration
+}
+
+// JobOutput описывает очередную часть вывода джоба, который ещё выполняется.
+//
+// Части приходят по порядку, и вместе образуют начало JobResult.Stdout и JobResult.Stderr.
+type JobOutput struct {
+	ID build.ID
+
+	Stdout, Stderr []byte
 }
 
 type WorkerID string
@@ -41,12 +120,46 @@ type HeartbeatRequest struct {
 	// FreeSlots сообщает, сколько еще процессов можно запустить на этом воркере.
 	FreeSlots int
 
+	// TotalResources сообщает, сколько всего ресурсов есть на этом воркере.
+	//
+	// Нулевое поле означает, что воркер не знает размер ресурса, и по нему джобы не ограничиваются.
+	TotalResources build.Resources
+
+	// FreeResources сообщает, сколько ресурсов не занято джобами, которые выполняются на воркере.
+	FreeResources build.Resources
+
+	// Labels задаёт метки воркера, например версию компилятора или класс машины.
+	Labels map[string]string
+
 	// JobResult сообщает координатору, какие джобы завершили исполнение на этом воркере
 	// на этой итерации цикла.
 	FinishedJob []JobResult
 
 	// AddedArtifacts говорит, какие артефакты появились в кеше на этой итерации цикла.
 	AddedArtifacts []build.ID
+
+	// Output содержит вывод выполняющихся джобов, появившийся с прошлого heartbeat-а.
+	//
+	// Вывод джоба приходит в Output раньше, чем его JobResult попадает в FinishedJob.
+	Output []JobOutput
+
+	// CanceledJobs подтверждает, что джобы из HeartbeatResponse.JobsToCancel остановлены.
+	//
+	// Процессы отменённого джоба завершены, а его временные директории удалены. Если джоб успел
+	// завершиться до отмены, его артефакт сообщается в AddedArtifacts, иначе артефакт не сохраняется.
+	CanceledJobs []build.ID
+
+	// BadArtifactSources перечисляет воркеры, с которых не удалось скачать артефакт.
+	//
+	// Координатор перестаёт считать такой воркер владельцем артефакта, если известен хотя бы один
+	// другой владелец.
+	BadArtifactSources []ArtifactSource
+}
+
+// ArtifactSource описывает воркер, хранящий артефакт.
+type ArtifactSource struct {
+	ID     build.ID
+	Worker WorkerID
 }
 
 // JobSpec описывает джоб, который нужно запустить.
@@ -57,11 +170,23 @@ type JobSpec struct {
 	// Artifacts задаёт воркеров, с которых можно скачать артефакты необходимые этому джобу.
 	Artifacts map[build.ID]WorkerID
 
+	// ArtifactSources задаёт для каждого артефакта из Artifacts все известные воркеры, на которых он есть,
+	// в порядке предпочтения. Воркер из Artifacts идёт первым.
+	ArtifactSources map[build.ID][]WorkerID
+
+	// DepNames задаёт Job.Name зависимостей джоба, см. build.Job.DepKeys.
+	DepNames map[build.ID]string
+
 	build.Job
 }
 
 type HeartbeatResponse struct {
 	JobsToRun map[build.ID]JobSpec
+
+	// JobsToCancel перечисляет джобы, которые воркер должен остановить, не дожидаясь их завершения.
+	//
+	// Например, если спекулятивная копия джоба уже завершилась на другом воркере.
+	JobsToCancel []build.ID
 }
 
 type HeartbeatService interface {
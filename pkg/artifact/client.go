@@ -6,55 +6,142 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
+	"net/url"
+	"os"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 	"gitlab.com/slon/shad-go/distbuild/pkg/tarstream"
 )
 
 // Download artifact from remote cache into local cache.
+//
+// If the artifact is already in the local cache, nothing is downloaded. Concurrent downloads
+// of the same artifact fail with ErrWriteLocked, use Downloader to share one transfer between them.
 func Download(ctx context.Context, endpoint string, c *Cache, artifactID build.ID) error {
+	dir, commit, abort, err := c.Create(artifactID)
+	if errors.Is(err, ErrExists) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := receive(ctx, endpoint, artifactID, dir); err != nil {
+		_ = abort()
+		return err
+	}
+	return commit()
+}
+
+func receive(ctx context.Context, endpoint string, artifactID build.ID, dir string) error {
 	url := endpoint + "/artifact?id=" + artifactID.String()
 
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return &sourceError{err}
 	}
 
 	httpResp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
-		return err
+		return &sourceError{err}
 	}
 	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode != http.StatusOK {
 		errorMessage := fmt.Sprintf("status code is not OK in handler - %d", httpResp.StatusCode)
-		return errors.New(errorMessage)
+		return &sourceError{errors.New(errorMessage)}
 	}
 
-	dir, commit, abort, err := c.Create(artifactID)
+	return streamError(tarstream.Receive(dir, httpResp.Body))
+}
+
+// DownloadPaths downloads only listed paths of the artifact into dir.
+//
+// Partial artifact never enters the cache, so that it is not mistaken for the whole one.
+func DownloadPaths(ctx context.Context, endpoint string, artifactID build.ID, paths []string, dir string) error {
+	query := url.Values{"id": {artifactID.String()}, "path": paths}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/artifact?"+query.Encode(), nil)
 	if err != nil {
-		dir2, unlock, err2 := c.Get(artifactID)
-		err = err2
-		if err != nil {
-			fmt.Println("error in artifact client: " + err.Error())
-			return err
-		}
-		dir = dir2
-		commit = func() error {
-			unlock()
-			return nil
-		}
-		abort = commit
+		return &sourceError{err}
 	}
 
-	err = tarstream.Receive(dir, httpResp.Body)
+	httpResp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
-		_ = abort()
-		return err
+		return &sourceError{err}
 	}
+	defer httpResp.Body.Close()
 
-	_ = commit()
+	if httpResp.StatusCode != http.StatusOK {
+		return &sourceError{fmt.Errorf("status code is not OK in handler - %d", httpResp.StatusCode)}
+	}
 
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	if err := tarstream.Receive(dir, httpResp.Body); err != nil {
+		_ = os.RemoveAll(dir)
+		return streamError(err)
+	}
 	return nil
 }
+
+// sourceError marks failure of the remote source: transport error, bad status or broken stream.
+type sourceError struct {
+	err error
+}
+
+func (e *sourceError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sourceError) Unwrap() error {
+	return e.err
+}
+
+// streamError blames the source for the error of received stream, unless the error comes from
+// the local file system.
+func streamError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return err
+	}
+	return &sourceError{err}
+}
+
+// Fallback calls download with each of the sources in order, until one of them succeeds.
+//
+// Sources, that failed, are returned in bad even if some later source succeeded. Only failures
+// of the source itself are blamed on it. Local errors, such as locked cache or full disk, and
+// cancellation of ctx stop the search and are returned as is.
+func Fallback(ctx context.Context, sources []string, download func(source string) error) (bad []string, err error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no sources to download from")
+	}
+
+	var errs []error
+	for _, source := range sources {
+		err := download(source)
+		if err == nil {
+			return bad, nil
+		}
+		if ctx.Err() != nil {
+			return bad, ctx.Err()
+		}
+
+		var srcErr *sourceError
+		if !errors.As(err, &srcErr) {
+			return bad, err
+		}
+
+		bad = append(bad, source)
+		errs = append(errs, fmt.Errorf("%s: %w", source, err))
+	}
+	return bad, errors.Join(errs...)
+}
@@ -49,3 +49,166 @@ func TestArtifactTransfer(t *testing.T) {
 	err = artifact.Download(ctx, server.URL, localCache.Cache, build.ID{0x02})
 	require.Error(t, err)
 }
+
+func TestArtifactTransferPaths(t *testing.T) {
+	remoteCache := newTestCache(t)
+
+	id := build.ID{0x01}
+
+	dir, commit, _, err := remoteCache.Create(id)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "lib"), 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lib", "a.a"), []byte("aaa"), 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "big.bin"), []byte("big"), 0777))
+	require.NoError(t, commit())
+
+	h := artifact.NewHandler(zaptest.NewLogger(t), remoteCache.Cache)
+	mux := http.NewServeMux()
+	h.Register(mux)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := context.Background()
+	to := filepath.Join(t.TempDir(), "partial")
+	require.NoError(t, artifact.DownloadPaths(ctx, server.URL, id, []string{"lib/a.a"}, to))
+
+	content, err := os.ReadFile(filepath.Join(to, "lib", "a.a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("aaa"), content)
+
+	_, err = os.Stat(filepath.Join(to, "big.bin"))
+	require.True(t, os.IsNotExist(err))
+
+	require.Error(t, artifact.DownloadPaths(ctx, server.URL, id, []string{"missing"}, t.TempDir()))
+	require.Error(t, artifact.DownloadPaths(ctx, server.URL, id, []string{"../escape"}, t.TempDir()))
+}
+
+func TestArtifactPathsSymlinkEscape(t *testing.T) {
+	remoteCache := newTestCache(t)
+
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(outside, "etc"), 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "etc", "shadow"), []byte("secret"), 0666))
+
+	id := build.ID{0x01}
+
+	dir, commit, _, err := remoteCache.Create(id)
+	require.NoError(t, err)
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "x")))
+	require.NoError(t, os.Symlink("/", filepath.Join(dir, "root")))
+	require.NoError(t, commit())
+
+	h := artifact.NewHandler(zaptest.NewLogger(t), remoteCache.Cache)
+	mux := http.NewServeMux()
+	h.Register(mux)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, path := range []string{"x/etc/shadow", "x/etc", "root/etc/shadow"} {
+		rsp, err := http.Get(server.URL + "/artifact?id=" + id.String() + "&path=" + path)
+		require.NoError(t, err)
+		rsp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, rsp.StatusCode, path)
+
+		to := t.TempDir()
+		require.Error(t, artifact.DownloadPaths(context.Background(), server.URL, id, []string{path}, to))
+
+		_, err = os.Stat(filepath.Join(to, "x", "etc", "shadow"))
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestArtifactFallback(t *testing.T) {
+	remoteCache := newTestCache(t)
+	emptyCache := newTestCache(t)
+	localCache := newTestCache(t)
+
+	id := build.ID{0x01}
+
+	dir, commit, _, err := remoteCache.Create(id)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("foobar"), 0777))
+	require.NoError(t, commit())
+
+	newServer := func(c *artifact.Cache) *httptest.Server {
+		mux := http.NewServeMux()
+		artifact.NewHandler(zaptest.NewLogger(t), c).Register(mux)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	empty := newServer(emptyCache.Cache)
+	remote := newServer(remoteCache.Cache)
+
+	ctx := context.Background()
+	sources := []string{empty.URL, remote.URL}
+	bad, err := artifact.Fallback(ctx, sources, func(source string) error {
+		return artifact.Download(ctx, source, localCache.Cache, id)
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{empty.URL}, bad)
+
+	_, unlock, err := localCache.Get(id)
+	require.NoError(t, err)
+	unlock()
+
+	bad, err = artifact.Fallback(ctx, []string{empty.URL}, func(source string) error {
+		return artifact.Download(ctx, source, localCache.Cache, build.ID{0x02})
+	})
+	require.Error(t, err)
+	require.Equal(t, []string{empty.URL}, bad)
+}
+
+func TestArtifactFallbackLocalErrors(t *testing.T) {
+	remoteCache := newTestCache(t)
+	localCache := newTestCache(t)
+
+	id := build.ID{0x01}
+
+	dir, commit, _, err := remoteCache.Create(id)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("foobar"), 0777))
+	require.NoError(t, commit())
+
+	mux := http.NewServeMux()
+	artifact.NewHandler(zaptest.NewLogger(t), remoteCache.Cache).Register(mux)
+	remote := httptest.NewServer(mux)
+	defer remote.Close()
+
+	ctx := context.Background()
+	sources := []string{remote.URL, remote.URL}
+
+	// Another download holds the write lock of the local cache.
+	_, _, abort, err := localCache.Create(id)
+	require.NoError(t, err)
+
+	bad, err := artifact.Fallback(ctx, sources, func(source string) error {
+		return artifact.Download(ctx, source, localCache.Cache, id)
+	})
+	require.ErrorIs(t, err, artifact.ErrWriteLocked)
+	require.Empty(t, bad)
+	require.NoError(t, abort())
+
+	// Destination can't be created on the local disk.
+	blocker := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(blocker, nil, 0666))
+
+	bad, err = artifact.Fallback(ctx, sources, func(source string) error {
+		return artifact.DownloadPaths(ctx, source, id, []string{"a.txt"}, filepath.Join(blocker, "partial"))
+	})
+	require.Error(t, err)
+	require.Empty(t, bad)
+
+	// Received file can't be written locally.
+	to := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(to, "a.txt"), 0777))
+
+	bad, err = artifact.Fallback(ctx, sources, func(source string) error {
+		return artifact.DownloadPaths(ctx, source, id, []string{"a.txt"}, to)
+	})
+	require.Error(t, err)
+	require.Empty(t, bad)
+}
@@ -0,0 +1,110 @@
+//go:build !solution
+
+package artifact
+
+import (
+	"context"
+	"sync"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// Downloader скачивает артефакты в локальный кеш, объединяя одновременные запросы одного артефакта.
+//
+// Все запросы артефакта, пришедшие во время скачивания, ждут одну передачу и её commit. Передача
+// отменяется, только когда от неё отказались все ждущие.
+type Downloader struct {
+	cache *Cache
+
+	mutex sync.Mutex
+	calls map[build.ID]*downloadCall
+}
+
+// downloadCall описывает одну передачу артефакта.
+type downloadCall struct {
+	done chan struct{}
+	bad  []string
+	err  error
+
+	waiters int
+	cancel  context.CancelFunc
+
+	// abandoned выставляется, когда все ждущие отказались от передачи и она отменена.
+	abandoned bool
+}
+
+func NewDownloader(c *Cache) *Downloader {
+	return &Downloader{cache: c, calls: make(map[build.ID]*downloadCall)}
+}
+
+// Download makes sure the artifact is in the local cache, downloading it from the first source that works.
+//
+// Sources, that failed, are returned in bad, see Fallback. Waiter, whose ctx is done, returns
+// ctx.Err() right away, while transfer continues for other waiters.
+func (d *Downloader) Download(ctx context.Context, id build.ID, sources []string) (bad []string, err error) {
+	for {
+		d.mutex.Lock()
+		call, ok := d.calls[id]
+		if ok && call.abandoned {
+			d.mutex.Unlock()
+
+			// Отменённая передача ещё держит артефакт на запись, новую можно начать только после неё.
+			select {
+			case <-call.done:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		if !ok {
+			if _, unlock, err := d.cache.Get(id); err == nil {
+				unlock()
+				d.mutex.Unlock()
+				return nil, nil
+			}
+
+			call = d.start(id, sources)
+		}
+		call.waiters++
+		d.mutex.Unlock()
+
+		select {
+		case <-call.done:
+			return call.bad, call.err
+		case <-ctx.Done():
+			d.mutex.Lock()
+			call.waiters--
+			if call.waiters == 0 {
+				call.abandoned = true
+				call.cancel()
+			}
+			d.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// start runs transfer in background. d.mutex must be held.
+func (d *Downloader) start(id build.ID, sources []string) *downloadCall {
+	ctx, cancel := context.WithCancel(context.Background())
+	call := &downloadCall{done: make(chan struct{}), cancel: cancel}
+	d.calls[id] = call
+
+	go func() {
+		defer cancel()
+
+		bad, err := Fallback(ctx, sources, func(source string) error {
+			return Download(ctx, source, d.cache, id)
+		})
+
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+
+		delete(d.calls, id)
+		call.bad, call.err = bad, err
+		close(call.done)
+	}()
+
+	return call
+}
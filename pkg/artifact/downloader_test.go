@@ -0,0 +1,147 @@
+package artifact_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// gatedServer serves artifacts of the cache, holding every request until gate is closed.
+type gatedServer struct {
+	*httptest.Server
+	gate     chan struct{}
+	requests atomic.Int32
+}
+
+func newGatedServer(t *testing.T, c *artifact.Cache) *gatedServer {
+	mux := http.NewServeMux()
+	artifact.NewHandler(zaptest.NewLogger(t), c).Register(mux)
+
+	s := &gatedServer{gate: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		select {
+		case <-s.gate:
+		case <-r.Context().Done():
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newRemoteArtifact(t *testing.T, id build.ID) *testCache {
+	remote := newTestCache(t)
+
+	dir, commit, _, err := remote.Create(id)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("foobar"), 0777))
+	require.NoError(t, commit())
+	return remote
+}
+
+func TestDownloaderSharesTransfer(t *testing.T) {
+	id := build.ID{0x01}
+	server := newGatedServer(t, newRemoteArtifact(t, id).Cache)
+	local := newTestCache(t)
+	d := artifact.NewDownloader(local.Cache)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = d.Download(context.Background(), id, []string{server.URL})
+		}()
+	}
+
+	require.Eventually(t, func() bool { return server.requests.Load() == 1 }, time.Second, 10*time.Millisecond)
+	close(server.gate)
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(1), server.requests.Load())
+
+	dir, unlock, err := local.Get(id)
+	require.NoError(t, err)
+	defer unlock()
+
+	content, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), content)
+
+	// Artifact is already in the cache, so nothing is downloaded again.
+	_, err = d.Download(context.Background(), id, []string{server.URL})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), server.requests.Load())
+}
+
+func TestDownloaderWaiterCancel(t *testing.T) {
+	id := build.ID{0x01}
+	server := newGatedServer(t, newRemoteArtifact(t, id).Cache)
+	local := newTestCache(t)
+	d := artifact.NewDownloader(local.Cache)
+
+	done := make(chan error)
+	go func() {
+		_, err := d.Download(context.Background(), id, []string{server.URL})
+		done <- err
+	}()
+
+	require.Eventually(t, func() bool { return server.requests.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// Waiter that gives up does not cancel transfer for the others.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.Download(ctx, id, []string{server.URL})
+	require.ErrorIs(t, err, context.Canceled)
+
+	close(server.gate)
+	require.NoError(t, <-done)
+	require.Equal(t, int32(1), server.requests.Load())
+
+	_, unlock, err := local.Get(id)
+	require.NoError(t, err)
+	unlock()
+}
+
+func TestDownloaderAbandonedTransfer(t *testing.T) {
+	id := build.ID{0x01}
+	server := newGatedServer(t, newRemoteArtifact(t, id).Cache)
+	local := newTestCache(t)
+	d := artifact.NewDownloader(local.Cache)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := d.Download(ctx, id, []string{server.URL})
+		errc <- err
+	}()
+
+	require.Eventually(t, func() bool { return server.requests.Load() == 1 }, time.Second, 10*time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-errc, context.Canceled)
+
+	// Abandoned transfer is not blamed on the source, and the next request starts a new one.
+	close(server.gate)
+	bad, err := d.Download(context.Background(), id, []string{server.URL})
+	require.NoError(t, err)
+	require.Empty(t, bad)
+	require.Equal(t, int32(2), server.requests.Load())
+}
@@ -3,7 +3,10 @@
 package artifact
 
 import (
+	"errors"
 	"net/http"
+	"os"
+	"path/filepath"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 	"gitlab.com/slon/shad-go/distbuild/pkg/tarstream"
@@ -36,14 +39,44 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	paths := r.URL.Query()["path"]
+	for _, path := range paths {
+		if !filepath.IsLocal(path) {
+			h.logger.Error("wrong artifact path in artifact handler", zap.String("path", path))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
 	dir, unlock, err := h.remoteCache.Get(artifact)
 	if err != nil {
 		h.logger.Error("Get from remote cache returned error")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	err = tarstream.Send(dir, w)
-	unlock()
+	defer unlock()
+
+	if len(paths) == 0 {
+		err = tarstream.Send(dir, w)
+	} else {
+		for _, path := range paths {
+			inside, err := insideDir(dir, path)
+			if err != nil || !inside {
+				h.logger.Error("requested path escapes artifact",
+					zap.String("artifact", artifact.String()), zap.String("path", path), zap.Error(err))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if _, err := os.Lstat(filepath.Join(dir, path)); err != nil {
+				h.logger.Error("requested path is missing in artifact",
+					zap.String("artifact", artifact.String()), zap.String("path", path))
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		}
+		err = tarstream.SendPaths(dir, paths, w)
+	}
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -51,6 +84,33 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// insideDir reports whether local path inside dir stays there after resolving symlinks in its parent
+// directories. The last element is not resolved, because symlinks are sent as is.
+func insideDir(dir, path string) (bool, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false, err
+	}
+
+	parent, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.Dir(path)))
+	if errors.Is(err, os.ErrNotExist) {
+		// Missing parent can't lead outside of dir.
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(root, parent)
+	if err != nil {
+		return false, err
+	}
+	return rel == "." || filepath.IsLocal(rel), nil
+}
+
+// Register adds handler to mux.
+//
+// GET /artifact?id=1234 returns whole artifact. Repeated path parameters restrict response
+// to the listed paths: GET /artifact?id=1234&path=lib.a&path=include.
 func (h *Handler) Register(mux *http.ServeMux) {
 	mux.Handle("GET /artifact", h)
 }
@@ -0,0 +1,69 @@
+// Package buildgen contains helpers shared by graph generators.
+package buildgen
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// Builder накапливает джобы и исходные файлы генерируемого графа.
+type Builder struct {
+	// SourceRoot задаёт абсолютный путь директории с исходным кодом.
+	SourceRoot string
+
+	// Graph содержит уже добавленные джобы и исходные файлы.
+	Graph *build.Graph
+}
+
+// NewBuilder returns builder of the empty graph with sources inside sourceRoot.
+func NewBuilder(sourceRoot string) *Builder {
+	return &Builder{
+		SourceRoot: sourceRoot,
+		Graph:      &build.Graph{SourceFiles: map[build.ID]string{}},
+	}
+}
+
+// RelPath returns slash separated path relative to the source root. ok is false for paths outside of it.
+func (b *Builder) RelPath(abs string) (rel string, ok bool) {
+	rel, err := filepath.Rel(b.SourceRoot, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// AddInput adds source file rel to the graph and to inputs of the job.
+//
+// ID of the file is appended to inputs, so that it is taken into account by AddJob.
+func (b *Builder) AddInput(job *build.Job, inputs *[]build.ID, rel string) error {
+	content, err := os.ReadFile(filepath.Join(b.SourceRoot, filepath.FromSlash(rel)))
+	if err != nil {
+		return err
+	}
+
+	id := build.FileID(rel, content)
+	b.Graph.SourceFiles[id] = rel
+	job.Inputs = append(job.Inputs, rel)
+	*inputs = append(*inputs, id)
+	return nil
+}
+
+// AddJob computes ID of the job from its content and inputs, and adds the job to the graph.
+func (b *Builder) AddJob(job build.Job, inputs []build.ID) build.ID {
+	job.ID = build.HashJob(&job, inputs)
+	b.Graph.Jobs = append(b.Graph.Jobs, job)
+	return job.ID
+}
+
+// AddDep adds id to deps of the job, unless it is already there.
+func AddDep(job *build.Job, id build.ID) {
+	for _, dep := range job.Deps {
+		if dep == id {
+			return
+		}
+	}
+	job.Deps = append(job.Deps, id)
+}
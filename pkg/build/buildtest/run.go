@@ -0,0 +1,82 @@
+// Package buildtest contains helpers for testing graph generators.
+package buildtest
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// Result describes outputs of the graph executed by Run.
+type Result struct {
+	// Stdout contains combined output of all commands, keyed by job name.
+	Stdout map[string]string
+
+	// OutputDir contains output directory of every job, keyed by job name.
+	OutputDir map[string]string
+}
+
+// Run executes graph locally, one job at a time, in the same way worker does.
+func Run(t *testing.T, graph *build.Graph, sourceDir string) *Result {
+	t.Helper()
+
+	result := &Result{
+		Stdout:    map[string]string{},
+		OutputDir: map[string]string{},
+	}
+	outputs := map[build.ID]string{}
+	names := map[build.ID]string{}
+	for _, job := range graph.Jobs {
+		names[job.ID] = job.Name
+	}
+
+	for _, job := range build.TopSort(graph.Jobs) {
+		outputDir := t.TempDir()
+		tmpDir := t.TempDir()
+
+		deps := map[build.ID]string{}
+		for _, dep := range job.Deps {
+			deps[dep] = outputs[dep]
+		}
+
+		for _, cmd := range job.Cmds {
+			rendered, err := cmd.Render(build.JobContext{
+				SourceDir:  sourceDir,
+				OutputDir:  outputDir,
+				TmpDir:     tmpDir,
+				JobID:      job.ID,
+				NumCPU:     runtime.NumCPU(),
+				Inputs:     job.Inputs,
+				Deps:       deps,
+				DepAliases: job.DepKeys(names),
+			})
+			require.NoError(t, err)
+
+			if len(rendered.Exec) == 0 {
+				require.NoError(t, rendered.RunFileOp(), job.Name)
+				continue
+			}
+
+			c := exec.Command(rendered.Exec[0], rendered.Exec[1:]...)
+			c.Dir = rendered.WorkingDirectory
+			if !filepath.IsAbs(c.Dir) {
+				c.Dir = filepath.Join(sourceDir, c.Dir)
+			}
+			c.Env = append(os.Environ(), rendered.Environ...)
+			out, err := c.CombinedOutput()
+			require.NoError(t, err, "%s: %s", job.Name, out)
+			result.Stdout[job.Name] += string(out)
+		}
+
+		outputs[job.ID] = outputDir
+		result.OutputDir[job.Name] = outputDir
+	}
+
+	return result
+}
@@ -1,36 +1,159 @@
 package build
 
 import (
+	"encoding/json"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"text/template"
 )
 
+// JobContext описывает значения, доступные в шаблонах команд джоба.
 type JobContext struct {
 	SourceDir string
 	OutputDir string
-	Deps      map[ID]string
+
+	// TmpDir задаёт временную директорию джоба, которая удаляется после его завершения.
+	TmpDir string
+
+	JobID    ID
+	WorkerID string
+
+	// NumCPU задаёт число ядер, доступных джобу.
+	NumCPU int
+
+	// Inputs задаёт входные файлы джоба относительно SourceDir.
+	Inputs []string
+
+	// Deps задаёт директории с выходами зависимостей.
+	Deps map[ID]string
+
+	// DepAliases задаёт дополнительные имена зависимостей из Deps, см. Job.DepKeys.
+	DepAliases map[string]ID
+}
+
+// DepKeys returns all names, under which deps of the job are available in templates.
+//
+// Each dep is available under its ID and under its Job.Name taken from names, unless several deps
+// share the same name. Job.DepAliases override other names.
+func (j *Job) DepKeys(names map[ID]string) map[string]ID {
+	keys := make(map[string]ID, len(j.Deps))
+	byName := make(map[string]ID, len(j.Deps))
+	ambiguous := make(map[string]bool)
+
+	for _, dep := range j.Deps {
+		keys[dep.String()] = dep
+
+		name := names[dep]
+		if name == "" {
+			continue
+		}
+		if other, ok := byName[name]; ok && other != dep {
+			ambiguous[name] = true
+		}
+		byName[name] = dep
+	}
+
+	for name, dep := range byName {
+		if _, ok := keys[name]; !ok && !ambiguous[name] {
+			keys[name] = dep
+		}
+	}
+
+	for alias, dep := range j.DepAliases {
+		keys[alias] = dep
+	}
+
+	return keys
+}
+
+// templateContext описывает значения, которые видят шаблоны команд.
+type templateContext struct {
+	SourceDir string
+	OutputDir string
+	TmpDir    string
+	JobID     string
+	WorkerID  string
+	NumCPU    int
+	Inputs    []string
+	Deps      map[string]string
+}
+
+// templateFuncs перечисляет функции, доступные в шаблонах команд.
+var templateFuncs = template.FuncMap{
+	"join":        templateJoin,
+	"quote":       shellQuote,
+	"basename":    filepath.Base,
+	"filesToArgs": filesToArgs,
+	"json":        jsonString,
+}
+
+// templateJoin takes separator first, so that list can be passed through a pipeline: {{.Inputs | join " "}}.
+func templateJoin(sep string, elems []string) string {
+	return strings.Join(elems, sep)
+}
+
+// shellQuote quotes s for POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// filesToArgs joins each file with dir and returns them as shell-quoted list of arguments.
+func filesToArgs(dir string, files []string) string {
+	args := make([]string, len(files))
+	for i, file := range files {
+		args[i] = shellQuote(filepath.Join(dir, file))
+	}
+	return strings.Join(args, " ")
+}
+
+// EscapeTemplate prevents text/template from interpreting content of the string,
+// so that it can be used as a part of command template.
+func EscapeTemplate(s string) string {
+	return strings.ReplaceAll(s, "{{", `{{"{{"}}`)
+}
+
+// jsonString returns s as JSON string literal.
+func jsonString(s string) (string, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
 }
 
 // Render replaces variable references with their real value.
+//
+// Returned error names the field of the command, which failed to render.
 func (c *Cmd) Render(ctx JobContext) (*Cmd, error) {
 	var errs []error
 
-	var fixedCtx struct {
-		SourceDir string
-		OutputDir string
-		Deps      map[string]string
+	fixedCtx := templateContext{
+		SourceDir: ctx.SourceDir,
+		OutputDir: ctx.OutputDir,
+		TmpDir:    ctx.TmpDir,
+		JobID:     ctx.JobID.String(),
+		WorkerID:  ctx.WorkerID,
+		NumCPU:    ctx.NumCPU,
+		Inputs:    ctx.Inputs,
+		Deps:      map[string]string{},
 	}
-	fixedCtx.SourceDir = ctx.SourceDir
-	fixedCtx.OutputDir = ctx.OutputDir
-	fixedCtx.Deps = map[string]string{}
 
 	for k, v := range ctx.Deps {
 		fixedCtx.Deps[k.String()] = v
 	}
+	for alias, id := range ctx.DepAliases {
+		if v, ok := ctx.Deps[id]; ok {
+			fixedCtx.Deps[alias] = v
+		}
+	}
 
-	render := func(str string) string {
-		t, err := template.New("").Parse(str)
+	render := func(field, str string) string {
+		t, err := parseTemplate(field, str)
 		if err != nil {
 			errs = append(errs, err)
 			return ""
@@ -45,21 +168,28 @@ func (c *Cmd) Render(ctx JobContext) (*Cmd, error) {
 		return b.String()
 	}
 
-	renderList := func(l []string) []string {
+	renderList := func(field string, l []string) []string {
 		var result []string
-		for _, in := range l {
-			result = append(result, render(in))
+		for i, in := range l {
+			result = append(result, render(fmt.Sprintf("%s[%d]", field, i), in))
 		}
 		return result
 	}
 
 	var rendered Cmd
 
-	rendered.CatOutput = render(c.CatOutput)
-	rendered.CatTemplate = render(c.CatTemplate)
-	rendered.WorkingDirectory = render(c.WorkingDirectory)
-	rendered.Exec = renderList(c.Exec)
-	rendered.Environ = renderList(c.Environ)
+	rendered.CatOutput = render("CatOutput", c.CatOutput)
+	rendered.CatTemplate = render("CatTemplate", c.CatTemplate)
+	rendered.CopySource = render("CopySource", c.CopySource)
+	rendered.CopyOutput = render("CopyOutput", c.CopyOutput)
+	rendered.MkdirPath = render("MkdirPath", c.MkdirPath)
+	rendered.SymlinkTarget = render("SymlinkTarget", c.SymlinkTarget)
+	rendered.SymlinkOutput = render("SymlinkOutput", c.SymlinkOutput)
+	rendered.RemovePath = render("RemovePath", c.RemovePath)
+	rendered.WorkingDirectory = render("WorkingDirectory", c.WorkingDirectory)
+	rendered.Exec = renderList("Exec", c.Exec)
+	rendered.Environ = renderList("Environ", c.Environ)
+	rendered.Timeout = c.Timeout
 
 	if len(errs) != 0 {
 		return nil, fmt.Errorf("error rendering cmd: %w", errs[0])
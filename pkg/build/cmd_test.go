@@ -29,3 +29,95 @@ func TestCmdRender(t *testing.T) {
 
 	require.Equal(t, expected, result)
 }
+
+func TestCmdRenderFileOps(t *testing.T) {
+	tmpl := Cmd{
+		SymlinkTarget: `{{index .Deps "6100000000000000000000000000000000000000"}}/lib.a`,
+		SymlinkOutput: "{{.OutputDir}}/lib.a",
+	}
+
+	ctx := JobContext{
+		OutputDir: "/distbuild/jobs/b",
+		Deps: map[ID]string{
+			{'a'}: "/distbuild/jobs/a",
+		},
+	}
+
+	result, err := tmpl.Render(ctx)
+	require.NoError(t, err)
+
+	expected := &Cmd{
+		SymlinkTarget: "/distbuild/jobs/a/lib.a",
+		SymlinkOutput: "/distbuild/jobs/b/lib.a",
+	}
+
+	require.Equal(t, expected, result)
+}
+
+func TestCmdRenderContext(t *testing.T) {
+	tmpl := Cmd{
+		Exec: []string{
+			"sh", "-c",
+			`cc -j{{.NumCPU}} -o {{quote .OutputDir}}/{{basename .SourceDir}} {{filesToArgs .SourceDir .Inputs}}`,
+			`{{index .Deps "lib"}}`,
+			"{{.TmpDir}} {{.JobID}} {{.WorkerID}}",
+			`{{.Inputs | join ","}}`,
+			`{"dir": {{printf "%s/\"q\"" .OutputDir | json}}}`,
+		},
+	}
+
+	ctx := JobContext{
+		SourceDir: "/distbuild/src",
+		OutputDir: "/distbuild/jobs/my out",
+		TmpDir:    "/tmp/b",
+		JobID:     ID{'b'},
+		WorkerID:  "http://localhost:8080",
+		NumCPU:    4,
+		Inputs:    []string{"a.c", "it's.c"},
+		Deps: map[ID]string{
+			{'a'}: "/distbuild/jobs/a",
+		},
+		DepAliases: map[string]ID{"lib": {'a'}},
+	}
+
+	result, err := tmpl.Render(ctx)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{
+		"sh", "-c",
+		`cc -j4 -o '/distbuild/jobs/my out'/src /distbuild/src/a.c '/distbuild/src/it'\''s.c'`,
+		"/distbuild/jobs/a",
+		"/tmp/b " + ID{'b'}.String() + " http://localhost:8080",
+		"a.c,it's.c",
+		`{"dir": "/distbuild/jobs/my out/\"q\""}`,
+	}, result.Exec)
+}
+
+func TestCmdRenderError(t *testing.T) {
+	_, err := (&Cmd{Exec: []string{"echo", "{{.NoSuchField}}"}}).Render(JobContext{})
+	require.ErrorContains(t, err, "Exec[1]")
+
+	_, err = (&Cmd{CatOutput: "{{nosuchfunc}}"}).Render(JobContext{})
+	require.ErrorContains(t, err, "CatOutput")
+}
+
+func TestJobDepKeys(t *testing.T) {
+	job := Job{
+		Deps:       []ID{{'a'}, {'b'}, {'c'}},
+		DepAliases: map[string]ID{"main": {'c'}},
+	}
+
+	names := map[ID]string{
+		{'a'}: "lib",
+		{'b'}: "tool",
+		{'c'}: "tool",
+	}
+
+	require.Equal(t, map[string]ID{
+		ID{'a'}.String(): {'a'},
+		ID{'b'}.String(): {'b'},
+		ID{'c'}.String(): {'c'},
+		"lib":            {'a'},
+		"main":           {'c'},
+	}, job.DepKeys(names))
+}
@@ -0,0 +1,61 @@
+package build
+
+import (
+	"errors"
+	"strings"
+)
+
+// Constraint задаёт требование к меткам воркера, на котором можно запустить джоб.
+//
+//	gcc=12   - у воркера есть метка gcc со значением 12
+//	gcc!=11  - у воркера нет метки gcc, или её значение не 11
+//	bigmem   - у воркера есть метка bigmem с любым значением
+//	!bigmem  - у воркера нет метки bigmem
+type Constraint string
+
+// Match checks whether worker labels satisfy the constraint.
+//
+// Malformed constraint never matches.
+func (c Constraint) Match(labels map[string]string) bool {
+	key, op, value, err := c.parse()
+	if err != nil {
+		return false
+	}
+
+	actual, ok := labels[key]
+	switch op {
+	case "=":
+		return ok && actual == value
+	case "!=":
+		return !ok || actual != value
+	case "!":
+		return !ok
+	default:
+		return ok
+	}
+}
+
+func (c Constraint) parse() (key, op, value string, err error) {
+	s := string(c)
+
+	switch {
+	case strings.Contains(s, "!="):
+		key, value, _ = strings.Cut(s, "!=")
+		op = "!="
+	case strings.Contains(s, "="):
+		key, value, _ = strings.Cut(s, "=")
+		op = "="
+	case strings.HasPrefix(s, "!"):
+		key = s[1:]
+		op = "!"
+	default:
+		key = s
+	}
+
+	key = strings.TrimSpace(key)
+	value = strings.TrimSpace(value)
+	if key == "" || strings.ContainsAny(key, "=!") {
+		return "", "", "", errors.New("label name is empty or malformed")
+	}
+	return key, op, value, nil
+}
@@ -0,0 +1,43 @@
+package build
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConstraintMatch(t *testing.T) {
+	labels := map[string]string{"gcc": "12", "bigmem": ""}
+
+	for _, tc := range []struct {
+		constraint Constraint
+		match      bool
+	}{
+		{"gcc=12", true},
+		{"gcc=11", false},
+		{"gcc!=11", true},
+		{"gcc!=12", false},
+		{"clang!=15", true},
+		{"bigmem", true},
+		{"ssd", false},
+		{"!ssd", true},
+		{"!bigmem", false},
+		{"=12", false},
+		{"", false},
+	} {
+		require.Equal(t, tc.match, tc.constraint.Match(labels), "%q", tc.constraint)
+	}
+}
+
+func TestValidateConstraints(t *testing.T) {
+	g := Graph{
+		Jobs: []Job{
+			{ID: ID{'a'}, Constraints: []Constraint{"gcc=12", "!="}},
+		},
+	}
+
+	var constraintErr *ConstraintError
+	require.True(t, errors.As(g.Validate(), &constraintErr))
+	require.Equal(t, Constraint("!="), constraintErr.Constraint)
+}
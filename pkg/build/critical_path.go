@@ -0,0 +1,36 @@
+package build
+
+import "time"
+
+// CriticalPath computes for every job the longest path from the job to the end of the build.
+//
+// Path length is the sum of estimated durations of the job itself and of all jobs that
+// transitively depend on it along the path. Jobs with the longest path should be started first,
+// because the build can't finish earlier than their path does.
+//
+// Graph must contain no cycles. Deps that are not present in jobs are ignored.
+func CriticalPath(jobs []Job, estimate func(job *Job) time.Duration) map[ID]time.Duration {
+	sorted := TopSort(jobs)
+
+	dependents := make(map[ID][]ID, len(sorted))
+	for i := range sorted {
+		for _, dep := range sorted[i].Deps {
+			dependents[dep] = append(dependents[dep], sorted[i].ID)
+		}
+	}
+
+	paths := make(map[ID]time.Duration, len(sorted))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		job := &sorted[i]
+
+		var longest time.Duration
+		for _, dependent := range dependents[job.ID] {
+			if paths[dependent] > longest {
+				longest = paths[dependent]
+			}
+		}
+		paths[job.ID] = estimate(job) + longest
+	}
+
+	return paths
+}
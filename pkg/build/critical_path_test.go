@@ -0,0 +1,37 @@
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCriticalPath(t *testing.T) {
+	// a -> b -> d
+	// a -> c -> d, c is slow
+	// e is independent
+	jobs := []Job{
+		{ID: ID{'d'}, Name: "d", Deps: []ID{{'b'}, {'c'}}},
+		{ID: ID{'b'}, Name: "b", Deps: []ID{{'a'}}},
+		{ID: ID{'c'}, Name: "c", Deps: []ID{{'a'}}},
+		{ID: ID{'a'}, Name: "a"},
+		{ID: ID{'e'}, Name: "e"},
+	}
+
+	durations := map[string]time.Duration{"c": 10 * time.Second}
+	estimate := func(job *Job) time.Duration {
+		if d, ok := durations[job.Name]; ok {
+			return d
+		}
+		return time.Second
+	}
+
+	require.Equal(t, map[ID]time.Duration{
+		{'a'}: 12 * time.Second,
+		{'b'}: 2 * time.Second,
+		{'c'}: 11 * time.Second,
+		{'d'}: time.Second,
+		{'e'}: time.Second,
+	}, CriticalPath(jobs, estimate))
+}
@@ -0,0 +1,150 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CmdKind задаёт вид команды.
+type CmdKind string
+
+const (
+	CmdExec    CmdKind = "exec"
+	CmdCat     CmdKind = "cat"
+	CmdCopy    CmdKind = "copy"
+	CmdMkdir   CmdKind = "mkdir"
+	CmdSymlink CmdKind = "symlink"
+	CmdRemove  CmdKind = "remove"
+)
+
+// Kind returns kind of the command.
+//
+// Error is returned unless fields of exactly one kind are filled.
+func (c *Cmd) Kind() (CmdKind, error) {
+	kinds := c.kinds()
+	switch len(kinds) {
+	case 1:
+		return kinds[0], nil
+	case 0:
+		return "", errors.New("cmd has no kind")
+	default:
+		return "", fmt.Errorf("cmd mixes kinds %v", kinds)
+	}
+}
+
+func (c *Cmd) kinds() []CmdKind {
+	var kinds []CmdKind
+	if len(c.Exec) != 0 {
+		kinds = append(kinds, CmdExec)
+	}
+	if c.CatOutput != "" || c.CatTemplate != "" {
+		kinds = append(kinds, CmdCat)
+	}
+	if c.CopySource != "" || c.CopyOutput != "" {
+		kinds = append(kinds, CmdCopy)
+	}
+	if c.MkdirPath != "" {
+		kinds = append(kinds, CmdMkdir)
+	}
+	if c.SymlinkTarget != "" || c.SymlinkOutput != "" {
+		kinds = append(kinds, CmdSymlink)
+	}
+	if c.RemovePath != "" {
+		kinds = append(kinds, CmdRemove)
+	}
+	return kinds
+}
+
+// RunFileOp executes rendered command of any kind except exec in the current process.
+//
+// Parent directories of the output are created when needed.
+func (c *Cmd) RunFileOp() error {
+	kind, err := c.Kind()
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case CmdCat:
+		if c.CatOutput == "" {
+			return errors.New("cat: output is not set")
+		}
+		if err := os.MkdirAll(filepath.Dir(c.CatOutput), 0777); err != nil {
+			return fmt.Errorf("cat: %w", err)
+		}
+		if err := os.WriteFile(c.CatOutput, []byte(c.CatTemplate), 0666); err != nil {
+			return fmt.Errorf("cat: %w", err)
+		}
+		return nil
+
+	case CmdCopy:
+		if c.CopySource == "" || c.CopyOutput == "" {
+			return errors.New("copy: both source and output must be set")
+		}
+		if err := copyFile(c.CopySource, c.CopyOutput); err != nil {
+			return fmt.Errorf("copy: %w", err)
+		}
+		return nil
+
+	case CmdMkdir:
+		if err := os.MkdirAll(c.MkdirPath, 0777); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+		return nil
+
+	case CmdSymlink:
+		if c.SymlinkTarget == "" || c.SymlinkOutput == "" {
+			return errors.New("symlink: both target and output must be set")
+		}
+		if err := os.MkdirAll(filepath.Dir(c.SymlinkOutput), 0777); err != nil {
+			return fmt.Errorf("symlink: %w", err)
+		}
+		if err := os.Symlink(c.SymlinkTarget, c.SymlinkOutput); err != nil {
+			return fmt.Errorf("symlink: %w", err)
+		}
+		return nil
+
+	case CmdRemove:
+		if err := os.RemoveAll(c.RemovePath); err != nil {
+			return fmt.Errorf("remove: %w", err)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("%s cmd can't be run in process", kind)
+	}
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", from)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0777); err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
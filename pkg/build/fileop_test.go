@@ -0,0 +1,59 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunFileOp(t *testing.T) {
+	dir := t.TempDir()
+	content := "it's \"quoted\"\n$HOME `ls` \\n\n"
+
+	cmds := []Cmd{
+		{CatTemplate: content, CatOutput: filepath.Join(dir, "cat", "out.txt")},
+		{CopySource: filepath.Join(dir, "cat", "out.txt"), CopyOutput: filepath.Join(dir, "copy", "out.txt")},
+		{MkdirPath: filepath.Join(dir, "a", "b", "c")},
+		{SymlinkTarget: "../cat/out.txt", SymlinkOutput: filepath.Join(dir, "link", "out.txt")},
+		{CatTemplate: "tmp", CatOutput: filepath.Join(dir, "tmp", "file.txt")},
+		{RemovePath: filepath.Join(dir, "tmp")},
+	}
+
+	for _, cmd := range cmds {
+		require.NoError(t, cmd.RunFileOp())
+	}
+
+	for _, name := range []string{"cat/out.txt", "copy/out.txt", "link/out.txt"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, content, string(got), name)
+	}
+
+	target, err := os.Readlink(filepath.Join(dir, "link", "out.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "../cat/out.txt", target)
+
+	info, err := os.Stat(filepath.Join(dir, "a", "b", "c"))
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	_, err = os.Stat(filepath.Join(dir, "tmp"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRunFileOpErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, cmd := range []Cmd{
+		{},
+		{Exec: []string{"true"}},
+		{CopySource: filepath.Join(dir, "missing")},
+		{CopySource: filepath.Join(dir, "missing"), CopyOutput: filepath.Join(dir, "out")},
+		{SymlinkOutput: filepath.Join(dir, "link")},
+		{MkdirPath: dir, RemovePath: dir},
+	} {
+		require.Error(t, cmd.RunFileOp(), "%+v", cmd)
+	}
+}
@@ -1,5 +1,7 @@
 package build
 
+import "time"
+
 // Job описывает одну вершину графа сборки.
 type Job struct {
 	// ID задаёт уникальный идентификатор джоба.
@@ -27,8 +29,60 @@ type Job struct {
 	// Deps задаёт список джобов, выходы которых нужны для работы этого джоба.
 	Deps []ID
 
+	// DepPaths задаёт пути внутри выходов зависимостей, которые нужны джобу.
+	//
+	// Пути задаются относительно {{.OutputDir}} зависимости, директории передаются целиком.
+	// Воркер скачивает только эти пути, если выхода зависимости ещё нет в его кеше. Команды
+	// могут рассчитывать только на перечисленные пути. Зависимости, которых нет в DepPaths,
+	// скачиваются целиком.
+	DepPaths map[ID][]string
+
+	// DepAliases задаёт дополнительные имена зависимостей из Deps, по которым к их выходам
+	// можно обращаться в шаблонах команд: {{index .Deps "alias"}}.
+	DepAliases map[string]ID
+
 	// Cmds описывает список команд, которые нужно выполнить в рамках этого джоба.
 	Cmds []Cmd
+
+	// Timeout ограничивает суммарное время работы всех команд джоба.
+	//
+	// Нулевое значение означает, что используется ограничение по умолчанию из настроек координатора.
+	Timeout time.Duration
+
+	// Resources описывает ресурсы, которыми ограничены процессы джоба.
+	Resources Resources
+
+	// Constraints перечисляет требования к меткам воркера, на котором можно запустить джоб.
+	//
+	// Джоб запускается только на воркере, который удовлетворяет всем требованиям.
+	Constraints []Constraint
+
+	// Outputs перечисляет пути внутри {{.OutputDir}}, которые джоб обязан создать.
+	//
+	// Пути задаются относительно {{.OutputDir}} и могут содержать шаблоны в синтаксисе filepath.Match.
+	// Каждый путь или шаблон должен найти хотя бы один файл или директорию, иначе джоб завершается
+	// с ошибкой. Если Outputs пуст, выход джоба не проверяется.
+	Outputs []string
+
+	// StrictOutputs включает предупреждения о файлах в {{.OutputDir}}, которые не покрыты Outputs.
+	StrictOutputs bool
+
+	// CombinedLog просит воркер вернуть stdout и stderr команд одним журналом в порядке появления строк.
+	//
+	// Журнал возвращается в api.JobResult.Log.
+	CombinedLog bool
+}
+
+// Resources описывает ограничения ресурсов джоба. Нулевое значение поля снимает ограничение.
+type Resources struct {
+	// MilliCPU задаёт долю процессорного времени в тысячных долях ядра. 1000 соответствует одному ядру.
+	MilliCPU int64
+
+	// Memory задаёт максимальный объём памяти в байтах.
+	Memory int64
+
+	// Pids задаёт максимальное число процессов и потоков.
+	Pids int64
 }
 
 // Cmd описывает одну команду сборки.
@@ -36,8 +90,15 @@ type Job struct {
 // Есть несколько видов команд. Все виды команд описываются одной структурой.
 // Реальный тип определяется тем, какие поля структуры заполнены.
 //
-//	exec - выполняет произвольную команду
-//	cat  - записывает строку в файл
+//	exec    - выполняет произвольную команду
+//	cat     - записывает строку в файл
+//	copy    - копирует файл
+//	mkdir   - создаёт директорию вместе со всеми промежуточными директориями
+//	symlink - создаёт символическую ссылку
+//	remove  - удаляет файл или директорию вместе с содержимым
+//
+// Все виды команд, кроме exec, воркер выполняет сам, не запуская внешних процессов.
+// В одной команде должны быть заполнены поля ровно одного вида.
 //
 // Все строки в описании команды могут содержать в себе на переменные. Перед выполнением
 // реальной команды, переменные заменяются на их реальные значения.
@@ -46,21 +107,65 @@ type Job struct {
 //	{{.SourceDir}} - абсолютный путь до директории с исходными файлами.
 //	{{index .Deps "f374b81d81f641c8c3d5d5468081ef83b2c7dae9"}} - абсолютный путь до директории,
 //	содержащей выход джоба с id f374b81d81f641c8c3d5d5468081ef83b2c7dae9.
+//	{{index .Deps "build lib"}}  - то же самое для зависимости с Job.Name "build lib" или
+//	с таким именем в Job.DepAliases.
+//	{{.TmpDir}}    - абсолютный путь до временной директории джоба.
+//	{{.JobID}}     - id джоба.
+//	{{.WorkerID}}  - адрес воркера, на котором выполняется джоб.
+//	{{.NumCPU}}    - число ядер, доступных джобу.
+//	{{.Inputs}}    - входные файлы джоба относительно {{.SourceDir}}.
+//
+// Кроме стандартных функций text/template, в шаблонах доступны:
+//
+//	{{.Inputs | join " "}}               - склеивает список через разделитель.
+//	{{quote .OutputDir}}                 - экранирует строку для shell.
+//	{{basename .OutputDir}}              - последний элемент пути.
+//	{{filesToArgs .SourceDir .Inputs}}   - пути файлов внутри директории, экранированные для shell.
+//	{{json .SourceDir}}                  - строка в виде JSON литерала, вместе с кавычками.
 type Cmd struct {
 	// Exec описывает команду, которую нужно выполнить.
 	Exec []string
 
 	// Environ описывает переменные окружения, которые необходимы для работы команды из Exec.
+	//
+	// Команда не наследует окружение воркера: кроме Environ, воркер выставляет только PATH,
+	// а HOME и TMPDIR указывают на временную директорию джоба. Переменные из Environ
+	// переопределяют значения, выставленные воркером.
 	Environ []string
 
 	// WorkingDirectory задаёт рабочую директорию для команды из Exec.
+	//
+	// Пустое значение означает {{.SourceDir}}, относительный путь отсчитывается от {{.SourceDir}}.
 	WorkingDirectory string
 
+	// Timeout ограничивает время работы команды из Exec. Нулевое значение снимает ограничение.
+	//
+	// Команда в любом случае не может работать дольше, чем позволяет Job.Timeout.
+	Timeout time.Duration
+
 	// CatTemplate задаёт шаблон строки, которую нужно записать в файл.
 	CatTemplate string
 
 	// CatOutput задаёт выходной файл для команды типа cat.
 	CatOutput string
+
+	// CopySource задаёт файл, который нужно скопировать командой типа copy.
+	CopySource string
+
+	// CopyOutput задаёт путь, по которому нужно записать копию CopySource.
+	CopyOutput string
+
+	// MkdirPath задаёт директорию, которую нужно создать командой типа mkdir.
+	MkdirPath string
+
+	// SymlinkTarget задаёт путь, на который указывает ссылка, созданная командой типа symlink.
+	SymlinkTarget string
+
+	// SymlinkOutput задаёт путь, по которому нужно создать ссылку.
+	SymlinkOutput string
+
+	// RemovePath задаёт файл или директорию, которые нужно удалить командой типа remove.
+	RemovePath string
 }
 
 type Graph struct {
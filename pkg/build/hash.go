@@ -0,0 +1,44 @@
+package build
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"sort"
+)
+
+// FileID вычисляет ID файла с исходным кодом.
+//
+// В хеш входит не только содержимое, но и путь. Иначе два файла с одинаковым содержимым
+// получили бы одинаковый ID и перестали бы различаться в Graph.SourceFiles.
+func FileID(path string, content []byte) ID {
+	h := sha1.New()
+	_, _ = h.Write([]byte(path))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(content)
+
+	var id ID
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// HashJob computes job ID from job description and ids of its input files.
+//
+// job.ID is ignored. Order of inputs does not matter.
+func HashJob(job *Job, inputs []ID) ID {
+	sorted := append([]ID{}, inputs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+
+	desc := *job
+	desc.ID = ID{}
+
+	h := sha1.New()
+	enc := json.NewEncoder(h)
+	_ = enc.Encode(desc)
+	_ = enc.Encode(sorted)
+
+	var id ID
+	copy(id[:], h.Sum(nil))
+	return id
+}
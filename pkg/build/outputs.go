@@ -0,0 +1,86 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// MissingOutputsError сообщает о том, что джоб не создал объявленные в Job.Outputs пути.
+type MissingOutputsError struct {
+	Missing []string
+}
+
+func (e *MissingOutputsError) Error() string {
+	return "job did not produce declared outputs: " + strings.Join(e.Missing, ", ")
+}
+
+// CheckOutputs verifies output directory of the job against Job.Outputs.
+//
+// MissingOutputsError is returned, if some of the declared outputs match nothing. When
+// Job.StrictOutputs is set, undeclared lists files, that are not covered by Job.Outputs.
+// Directory is not checked at all if Job.Outputs is empty.
+func (j *Job) CheckOutputs(outputDir string) (undeclared []string, err error) {
+	if len(j.Outputs) == 0 {
+		return nil, nil
+	}
+
+	declared := make(map[string]struct{})
+	var missing []string
+	for _, output := range j.Outputs {
+		matches, err := filepath.Glob(filepath.Join(outputDir, output))
+		if err != nil {
+			return nil, fmt.Errorf("output %q: %w", output, err)
+		}
+
+		if len(matches) == 0 {
+			missing = append(missing, output)
+		}
+		for _, match := range matches {
+			declared[match] = struct{}{}
+		}
+	}
+
+	if len(missing) != 0 {
+		return nil, &MissingOutputsError{Missing: missing}
+	}
+
+	if !j.StrictOutputs {
+		return nil, nil
+	}
+
+	err = filepath.WalkDir(outputDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if _, ok := declared[path]; ok {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.IsDir() {
+			rel, err := filepath.Rel(outputDir, path)
+			if err != nil {
+				return err
+			}
+			undeclared = append(undeclared, rel)
+		}
+		return nil
+	})
+	return undeclared, err
+}
+
+// validateOutput checks that output is a valid pattern inside the output directory.
+func validateOutput(output string) error {
+	if !filepath.IsLocal(output) {
+		return errors.New("output must be a relative path inside output directory")
+	}
+
+	_, err := filepath.Match(output, "")
+	return err
+}
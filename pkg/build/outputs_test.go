@@ -0,0 +1,55 @@
+package build
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckOutputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"bin/app", "lib/a.a", "lib/b.a", "pkg/x/y.o", "stray.txt"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0777))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0666))
+	}
+
+	job := Job{Outputs: []string{"bin/app", "lib/*.a", "pkg"}}
+
+	undeclared, err := job.CheckOutputs(dir)
+	require.NoError(t, err)
+	require.Empty(t, undeclared)
+
+	job.StrictOutputs = true
+	undeclared, err = job.CheckOutputs(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"stray.txt"}, undeclared)
+
+	job.Outputs = append(job.Outputs, "lib/*.so", "doc")
+	_, err = job.CheckOutputs(dir)
+
+	var missing *MissingOutputsError
+	require.True(t, errors.As(err, &missing), "%v", err)
+	require.Equal(t, []string{"lib/*.so", "doc"}, missing.Missing)
+}
+
+func TestValidateOutputs(t *testing.T) {
+	g := Graph{
+		Jobs: []Job{
+			{ID: ID{'a'}, Outputs: []string{"lib/*.a", "../escape", "/abs", "bad["}},
+		},
+	}
+
+	err := g.Validate()
+	require.Error(t, err)
+
+	var outputs []string
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var outputErr *OutputError
+		require.True(t, errors.As(err, &outputErr), "%v", err)
+		outputs = append(outputs, outputErr.Output)
+	}
+	require.Equal(t, []string{"../escape", "/abs", "bad["}, outputs)
+}
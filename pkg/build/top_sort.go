@@ -1,6 +1,8 @@
 package build
 
 // TopSort sorts jobs in topological order assuming dependency graph contains no cycles.
+//
+// Deps that are not present in jobs are ignored. Use Graph.Validate to reject such graphs.
 func TopSort(jobs []Job) []Job {
 	var sorted []Job
 	visited := make([]bool, len(jobs))
@@ -18,7 +20,11 @@ func TopSort(jobs []Job) []Job {
 
 		visited[jobIndex] = true
 		for _, dep := range jobs[jobIndex].Deps {
-			visit(jobIDIndex[dep])
+			depIndex, ok := jobIDIndex[dep]
+			if !ok {
+				continue
+			}
+			visit(depIndex)
 		}
 		sorted = append(sorted, jobs[jobIndex])
 	}
@@ -0,0 +1,407 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template/parse"
+)
+
+// CycleError сообщает о цикле в графе зависимостей.
+//
+// Path содержит джобы, образующие цикл. Первый и последний элемент Path совпадают.
+type CycleError struct {
+	Path []ID
+}
+
+func (e *CycleError) Error() string {
+	parts := make([]string, len(e.Path))
+	for i, id := range e.Path {
+		parts[i] = id.String()
+	}
+	return "dependency cycle: " + strings.Join(parts, " -> ")
+}
+
+// UnknownDepError сообщает о зависимости на джоб, которого нет в графе.
+type UnknownDepError struct {
+	Job ID
+	Dep ID
+}
+
+func (e *UnknownDepError) Error() string {
+	return fmt.Sprintf("job %s depends on unknown job %s", e.Job, e.Dep)
+}
+
+// DuplicateJobError сообщает о том, что несколько джобов в графе имеют одинаковый ID.
+type DuplicateJobError struct {
+	ID ID
+}
+
+func (e *DuplicateJobError) Error() string {
+	return fmt.Sprintf("duplicate job %s", e.ID)
+}
+
+// MissingInputError сообщает о входном файле джоба, которого нет в Graph.SourceFiles.
+type MissingInputError struct {
+	Job   ID
+	Input string
+}
+
+func (e *MissingInputError) Error() string {
+	return fmt.Sprintf("job %s: input %q is not present in source files", e.Job, e.Input)
+}
+
+// UndeclaredDepError сообщает о том, что команда джоба ссылается на выход джоба,
+// который не указан в Job.Deps.
+type UndeclaredDepError struct {
+	Job ID
+	Cmd int
+	Dep string
+}
+
+func (e *UndeclaredDepError) Error() string {
+	return fmt.Sprintf("job %s: cmd %d references undeclared dep %q", e.Job, e.Cmd, e.Dep)
+}
+
+// DepAliasError сообщает о том, что Job.DepAliases ссылается на джоб, которого нет в Job.Deps.
+type DepAliasError struct {
+	Job   ID
+	Alias string
+	Dep   ID
+}
+
+func (e *DepAliasError) Error() string {
+	return fmt.Sprintf("job %s: dep alias %q refers to %s, which is not in deps", e.Job, e.Alias, e.Dep)
+}
+
+// DepPathError сообщает о некорректной записи в Job.DepPaths.
+type DepPathError struct {
+	Job  ID
+	Dep  ID
+	Path string
+	Err  error
+}
+
+func (e *DepPathError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("job %s: dep paths of %s: %v", e.Job, e.Dep, e.Err)
+	}
+	return fmt.Sprintf("job %s: dep path %q of %s: %v", e.Job, e.Path, e.Dep, e.Err)
+}
+
+func (e *DepPathError) Unwrap() error {
+	return e.Err
+}
+
+// TemplateError сообщает о синтаксической ошибке в шаблоне команды.
+type TemplateError struct {
+	Job ID
+	Cmd int
+	Err error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("job %s: cmd %d: %v", e.Job, e.Cmd, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// CmdKindError сообщает о команде, в которой не заполнены поля ни одного вида
+// или заполнены поля нескольких видов.
+type CmdKindError struct {
+	Job   ID
+	Cmd   int
+	Kinds []CmdKind
+}
+
+func (e *CmdKindError) Error() string {
+	if len(e.Kinds) == 0 {
+		return fmt.Sprintf("job %s: cmd %d has no kind", e.Job, e.Cmd)
+	}
+
+	kinds := make([]string, len(e.Kinds))
+	for i, kind := range e.Kinds {
+		kinds[i] = string(kind)
+	}
+	return fmt.Sprintf("job %s: cmd %d mixes kinds %s", e.Job, e.Cmd, strings.Join(kinds, ", "))
+}
+
+// OutputError сообщает о некорректном пути в Job.Outputs.
+type OutputError struct {
+	Job    ID
+	Output string
+	Err    error
+}
+
+func (e *OutputError) Error() string {
+	return fmt.Sprintf("job %s: output %q: %v", e.Job, e.Output, e.Err)
+}
+
+func (e *OutputError) Unwrap() error {
+	return e.Err
+}
+
+// ConstraintError сообщает о синтаксической ошибке в требовании к меткам воркера.
+type ConstraintError struct {
+	Job        ID
+	Constraint Constraint
+	Err        error
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("job %s: constraint %q: %v", e.Job, e.Constraint, e.Err)
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks that graph is well-formed.
+//
+// All found problems are returned together, joined with errors.Join.
+// Individual problems can be inspected with errors.As.
+func (g *Graph) Validate() error {
+	var errs []error
+
+	jobs := make(map[ID]*Job, len(g.Jobs))
+	for i := range g.Jobs {
+		job := &g.Jobs[i]
+		if _, ok := jobs[job.ID]; ok {
+			errs = append(errs, &DuplicateJobError{ID: job.ID})
+			continue
+		}
+		jobs[job.ID] = job
+	}
+
+	sourcePaths := make(map[string]struct{}, len(g.SourceFiles))
+	for _, path := range g.SourceFiles {
+		sourcePaths[path] = struct{}{}
+	}
+
+	for i := range g.Jobs {
+		job := &g.Jobs[i]
+
+		names := make(map[ID]string, len(job.Deps))
+		for _, dep := range job.Deps {
+			if depJob, ok := jobs[dep]; ok {
+				names[dep] = depJob.Name
+			} else {
+				errs = append(errs, &UnknownDepError{Job: job.ID, Dep: dep})
+			}
+		}
+
+		for dep, paths := range job.DepPaths {
+			if !slices.Contains(job.Deps, dep) {
+				errs = append(errs, &DepPathError{Job: job.ID, Dep: dep, Err: errors.New("dep is not in deps")})
+			}
+			for _, path := range paths {
+				if !filepath.IsLocal(path) {
+					errs = append(errs, &DepPathError{Job: job.ID, Dep: dep, Path: path,
+						Err: errors.New("path must be relative to output of the dep")})
+				}
+			}
+		}
+
+		for alias, dep := range job.DepAliases {
+			if !slices.Contains(job.Deps, dep) {
+				errs = append(errs, &DepAliasError{Job: job.ID, Alias: alias, Dep: dep})
+			}
+		}
+
+		declared := job.DepKeys(names)
+
+		for _, input := range job.Inputs {
+			if _, ok := sourcePaths[input]; !ok {
+				errs = append(errs, &MissingInputError{Job: job.ID, Input: input})
+			}
+		}
+
+		for _, output := range job.Outputs {
+			if err := validateOutput(output); err != nil {
+				errs = append(errs, &OutputError{Job: job.ID, Output: output, Err: err})
+			}
+		}
+
+		for _, constraint := range job.Constraints {
+			if _, _, _, err := constraint.parse(); err != nil {
+				errs = append(errs, &ConstraintError{Job: job.ID, Constraint: constraint, Err: err})
+			}
+		}
+
+		for cmdIndex := range job.Cmds {
+			if kinds := job.Cmds[cmdIndex].kinds(); len(kinds) != 1 {
+				errs = append(errs, &CmdKindError{Job: job.ID, Cmd: cmdIndex, Kinds: kinds})
+			}
+
+			refs, err := job.Cmds[cmdIndex].depRefs()
+			if err != nil {
+				errs = append(errs, &TemplateError{Job: job.ID, Cmd: cmdIndex, Err: err})
+				continue
+			}
+
+			for _, ref := range refs {
+				if _, ok := declared[ref]; !ok {
+					errs = append(errs, &UndeclaredDepError{Job: job.ID, Cmd: cmdIndex, Dep: ref})
+				}
+			}
+		}
+	}
+
+	if cycle := findCycle(g.Jobs, jobs); cycle != nil {
+		errs = append(errs, &CycleError{Path: cycle})
+	}
+
+	return errors.Join(errs...)
+}
+
+func findCycle(order []Job, jobs map[ID]*Job) []ID {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+
+	state := make(map[ID]int, len(jobs))
+	var stack []ID
+
+	var visit func(id ID) []ID
+	visit = func(id ID) []ID {
+		switch state[id] {
+		case done:
+			return nil
+		case inProgress:
+			for i := range stack {
+				if stack[i] == id {
+					cycle := append([]ID{}, stack[i:]...)
+					return append(cycle, id)
+				}
+			}
+		}
+
+		job, ok := jobs[id]
+		if !ok {
+			return nil
+		}
+
+		state[id] = inProgress
+		stack = append(stack, id)
+		for _, dep := range job.Deps {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[id] = done
+		return nil
+	}
+
+	for _, job := range order {
+		if cycle := visit(job.ID); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// depRefs returns ids of all deps referenced from templates as {{index .Deps "..."}}.
+func (c *Cmd) depRefs() ([]string, error) {
+	var refs []string
+	for _, str := range c.templates() {
+		t, err := parseTemplate("", str)
+		if err != nil {
+			return nil, err
+		}
+
+		if t.Tree != nil {
+			refs = append(refs, depRefsInNode(t.Tree.Root)...)
+		}
+	}
+	return refs, nil
+}
+
+func (c *Cmd) templates() []string {
+	l := []string{
+		c.CatOutput, c.CatTemplate, c.WorkingDirectory,
+		c.CopySource, c.CopyOutput, c.MkdirPath,
+		c.SymlinkTarget, c.SymlinkOutput, c.RemovePath,
+	}
+	l = append(l, c.Exec...)
+	l = append(l, c.Environ...)
+	return l
+}
+
+func depRefsInNode(node parse.Node) []string {
+	var refs []string
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			refs = append(refs, depRefsInNode(child)...)
+		}
+
+	case *parse.ActionNode:
+		refs = append(refs, depRefsInNode(n.Pipe)...)
+
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			refs = append(refs, depRefsInNode(cmd)...)
+		}
+
+	case *parse.CommandNode:
+		if ref, ok := indexDepsRef(n); ok {
+			refs = append(refs, ref)
+		}
+		for _, arg := range n.Args {
+			refs = append(refs, depRefsInNode(arg)...)
+		}
+
+	case *parse.IfNode:
+		refs = append(refs, depRefsInBranch(&n.BranchNode)...)
+	case *parse.RangeNode:
+		refs = append(refs, depRefsInBranch(&n.BranchNode)...)
+	case *parse.WithNode:
+		refs = append(refs, depRefsInBranch(&n.BranchNode)...)
+	}
+
+	return refs
+}
+
+func depRefsInBranch(n *parse.BranchNode) []string {
+	refs := depRefsInNode(n.Pipe)
+	refs = append(refs, depRefsInNode(n.List)...)
+	refs = append(refs, depRefsInNode(n.ElseList)...)
+	return refs
+}
+
+func indexDepsRef(n *parse.CommandNode) (string, bool) {
+	if len(n.Args) != 3 {
+		return "", false
+	}
+
+	fn, ok := n.Args[0].(*parse.IdentifierNode)
+	if !ok || fn.Ident != "index" {
+		return "", false
+	}
+
+	field, ok := n.Args[1].(*parse.FieldNode)
+	if !ok || len(field.Ident) != 1 || field.Ident[0] != "Deps" {
+		return "", false
+	}
+
+	key, ok := n.Args[2].(*parse.StringNode)
+	if !ok {
+		return "", false
+	}
+
+	return key.Text, true
+}
@@ -0,0 +1,188 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOK(t *testing.T) {
+	g := Graph{
+		SourceFiles: map[ID]string{{'s'}: "a.txt"},
+		Jobs: []Job{
+			{
+				ID:     ID{'a'},
+				Inputs: []string{"a.txt"},
+				Cmds: []Cmd{
+					{CatTemplate: "OK", CatOutput: "{{.OutputDir}}/out.txt"},
+				},
+			},
+			{
+				ID:   ID{'b'},
+				Deps: []ID{{'a'}},
+				Cmds: []Cmd{
+					{Exec: []string{"cat", fmt.Sprintf("{{index .Deps %q}}/out.txt", ID{'a'})}},
+				},
+			},
+		},
+	}
+
+	require.NoError(t, g.Validate())
+}
+
+func TestValidateCycle(t *testing.T) {
+	g := Graph{
+		Jobs: []Job{
+			{ID: ID{'a'}, Deps: []ID{{'b'}}},
+			{ID: ID{'b'}, Deps: []ID{{'c'}}},
+			{ID: ID{'c'}, Deps: []ID{{'a'}}},
+		},
+	}
+
+	err := g.Validate()
+
+	var cycleErr *CycleError
+	require.True(t, errors.As(err, &cycleErr), "%v", err)
+	require.Equal(t, []ID{{'a'}, {'b'}, {'c'}, {'a'}}, cycleErr.Path)
+}
+
+func TestValidateErrors(t *testing.T) {
+	g := Graph{
+		SourceFiles: map[ID]string{{'s'}: "a.txt"},
+		Jobs: []Job{
+			{
+				ID:     ID{'a'},
+				Inputs: []string{"a.txt", "b.txt"},
+				Deps:   []ID{{'x'}},
+			},
+			{
+				ID: ID{'a'},
+			},
+			{
+				ID: ID{'b'},
+				Cmds: []Cmd{
+					{Exec: []string{"true"}},
+					{Exec: []string{"cat", fmt.Sprintf("{{index .Deps %q}}/out.txt", ID{'a'})}},
+					{Exec: []string{"{{.OutputDir"}},
+				},
+			},
+		},
+	}
+
+	err := g.Validate()
+	require.Error(t, err)
+
+	var unknownDep *UnknownDepError
+	require.True(t, errors.As(err, &unknownDep))
+	require.Equal(t, &UnknownDepError{Job: ID{'a'}, Dep: ID{'x'}}, unknownDep)
+
+	var duplicate *DuplicateJobError
+	require.True(t, errors.As(err, &duplicate))
+	require.Equal(t, ID{'a'}, duplicate.ID)
+
+	var missingInput *MissingInputError
+	require.True(t, errors.As(err, &missingInput))
+	require.Equal(t, "b.txt", missingInput.Input)
+
+	var undeclared *UndeclaredDepError
+	require.True(t, errors.As(err, &undeclared))
+	require.Equal(t, &UndeclaredDepError{Job: ID{'b'}, Cmd: 1, Dep: ID{'a'}.String()}, undeclared)
+
+	var templateErr *TemplateError
+	require.True(t, errors.As(err, &templateErr))
+	require.Equal(t, 2, templateErr.Cmd)
+}
+
+func TestValidateCmdKind(t *testing.T) {
+	g := Graph{
+		Jobs: []Job{
+			{
+				ID: ID{'a'},
+				Cmds: []Cmd{
+					{MkdirPath: "{{.OutputDir}}/lib"},
+					{},
+					{Exec: []string{"true"}, CatOutput: "{{.OutputDir}}/out.txt"},
+				},
+			},
+		},
+	}
+
+	err := g.Validate()
+	require.Error(t, err)
+
+	var kindErrs []*CmdKindError
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var kindErr *CmdKindError
+		require.True(t, errors.As(err, &kindErr), "%v", err)
+		kindErrs = append(kindErrs, kindErr)
+	}
+
+	require.Equal(t, []*CmdKindError{
+		{Job: ID{'a'}, Cmd: 1},
+		{Job: ID{'a'}, Cmd: 2, Kinds: []CmdKind{CmdExec, CmdCat}},
+	}, kindErrs)
+}
+
+func TestValidateDepAliases(t *testing.T) {
+	g := Graph{
+		Jobs: []Job{
+			{ID: ID{'a'}, Name: "lib"},
+			{
+				ID:         ID{'b'},
+				Deps:       []ID{{'a'}},
+				DepAliases: map[string]ID{"base": {'a'}, "other": {'x'}},
+				Cmds: []Cmd{
+					{Exec: []string{"cat", `{{index .Deps "lib"}}/out.txt`, `{{index .Deps "base"}}/out.txt`}},
+					{Exec: []string{"cat", `{{index .Deps "missing"}}/out.txt`}},
+					{Exec: []string{"echo", `{{.Inputs | join " "}}`, "{{quote .OutputDir}}"}},
+				},
+			},
+		},
+	}
+
+	err := g.Validate()
+	require.Error(t, err)
+
+	var errs []error
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		errs = append(errs, err)
+	}
+
+	require.Equal(t, []error{
+		&DepAliasError{Job: ID{'b'}, Alias: "other", Dep: ID{'x'}},
+		&UndeclaredDepError{Job: ID{'b'}, Cmd: 1, Dep: "missing"},
+	}, errs)
+}
+
+func TestValidateDepPaths(t *testing.T) {
+	g := Graph{
+		Jobs: []Job{
+			{ID: ID{'a'}},
+			{
+				ID:       ID{'b'},
+				Deps:     []ID{{'a'}},
+				DepPaths: map[ID][]string{{'a'}: {"lib/a.a", "../escape"}},
+			},
+		},
+	}
+
+	err := g.Validate()
+
+	var depPathErr *DepPathError
+	require.True(t, errors.As(err, &depPathErr), "%v", err)
+	require.Equal(t, "../escape", depPathErr.Path)
+}
+
+func TestTopSortUnknownDep(t *testing.T) {
+	jobs := []Job{
+		{ID: ID{'a'}, Deps: []ID{{'x'}}},
+		{ID: ID{'b'}, Deps: []ID{{'a'}}},
+	}
+
+	sorted := TopSort(jobs)
+	require.Equal(t, 2, len(sorted))
+	require.Equal(t, ID{'a'}, sorted[0].ID)
+	require.Equal(t, ID{'b'}, sorted[1].ID)
+}
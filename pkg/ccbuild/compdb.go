@@ -0,0 +1,153 @@
+package ccbuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CompileCommand описывает одну запись compile_commands.json.
+//
+// См. https://clang.llvm.org/docs/JSONCompilationDatabase.html
+type CompileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments,omitempty"`
+	Command   string   `json:"command,omitempty"`
+	Output    string   `json:"output,omitempty"`
+}
+
+// Args returns compiler invocation as list of arguments.
+func (c *CompileCommand) Args() ([]string, error) {
+	if len(c.Arguments) != 0 {
+		return c.Arguments, nil
+	}
+
+	if c.Command == "" {
+		return nil, fmt.Errorf("compile command for %s is empty", c.File)
+	}
+
+	return splitCommand(c.Command)
+}
+
+// LinkTarget описывает один выходной файл, собираемый из объектных файлов.
+type LinkTarget struct {
+	// Output задаёт имя выходного файла. Например, libfoo.a или hello.
+	Output string `json:"output"`
+
+	// Kind задаёт тип выходного файла: exe, shared или static.
+	Kind string `json:"kind"`
+
+	// Sources перечисляет файлы из compile_commands.json, объектные файлы которых нужно слинковать.
+	Sources []string `json:"sources"`
+
+	// Deps перечисляет Output других целей, с которыми нужно слинковать эту цель.
+	Deps []string `json:"deps,omitempty"`
+
+	// Linker задаёт команду линковки. По умолчанию используется компилятор первого source файла.
+	Linker []string `json:"linker,omitempty"`
+
+	// Flags задаёт дополнительные флаги линковки, которые передаются после объектных файлов.
+	Flags []string `json:"flags,omitempty"`
+}
+
+const (
+	KindExe    = "exe"
+	KindShared = "shared"
+	KindStatic = "static"
+)
+
+// ParseCompileCommands reads compile_commands.json.
+//
+// Relative directories are resolved against location of the file.
+func ParseCompileCommands(path string) ([]CompileCommand, error) {
+	var cmds []CompileCommand
+	if err := readJSON(path, &cmds); err != nil {
+		return nil, err
+	}
+
+	base, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range cmds {
+		if !filepath.IsAbs(cmds[i].Directory) {
+			cmds[i].Directory = filepath.Join(base, cmds[i].Directory)
+		}
+	}
+	return cmds, nil
+}
+
+// ParseLinkTargets reads link description, a json list of LinkTarget.
+func ParseLinkTargets(path string) ([]LinkTarget, error) {
+	var targets []LinkTarget
+	if err := readJSON(path, &targets); err != nil {
+		return nil, err
+	}
+	return targets, nil
+}
+
+func readJSON(path string, v any) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// splitCommand splits shell command line into arguments.
+//
+// Only quoting and escaping are supported, which is enough for commands produced by build systems.
+func splitCommand(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range command {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote in command %q", command)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
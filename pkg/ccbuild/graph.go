@@ -0,0 +1,394 @@
+package ccbuild
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build/buildgen"
+)
+
+// Config задаёт параметры импорта.
+type Config struct {
+	// SourceRoot задаёт директорию, которую клиент использует как директорию с исходным кодом.
+	SourceRoot string
+
+	// ScanHeaders включает поиск заголовочных файлов запуском компилятора с флагом -MM.
+	//
+	// Если ScanHeaders выключен, все заголовочные файлы из SourceRoot становятся входами каждого
+	// джоба компиляции.
+	ScanHeaders bool
+}
+
+// pathFlags are compiler flags followed by a path, either as a separate argument or glued to the flag.
+var pathFlags = []string{"-I", "-iquote", "-isystem", "-idirafter", "-include", "-imacros"}
+
+// depFileFlags control generation of make dependency files. They are dropped from the commands.
+var depFileFlags = map[string]bool{"-MD": false, "-MMD": false, "-MF": true, "-MT": true, "-MQ": true}
+
+var headerExts = map[string]bool{".h": true, ".hh": true, ".hpp": true, ".hxx": true, ".inc": true}
+
+type generator struct {
+	*buildgen.Builder
+
+	config Config
+
+	headers []string
+
+	objects  map[string]compiled
+	linked   map[string]build.ID
+	targets  map[string]*LinkTarget
+	visiting map[string]bool
+}
+
+type compiled struct {
+	id       build.ID
+	object   string
+	compiler string
+}
+
+// Generate converts compilation database and link description into a build graph.
+//
+// Graph contains one compile job per translation unit and one link job per link target.
+func Generate(cmds []CompileCommand, targets []LinkTarget, config Config) (*build.Graph, error) {
+	root, err := filepath.Abs(config.SourceRoot)
+	if err != nil {
+		return nil, err
+	}
+	config.SourceRoot = root
+
+	g := &generator{
+		Builder:  buildgen.NewBuilder(root),
+		config:   config,
+		objects:  map[string]compiled{},
+		linked:   map[string]build.ID{},
+		targets:  map[string]*LinkTarget{},
+		visiting: map[string]bool{},
+	}
+
+	if !config.ScanHeaders {
+		if g.headers, err = g.findHeaders(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range cmds {
+		if err := g.compile(&cmds[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range targets {
+		if _, ok := g.targets[targets[i].Output]; ok {
+			return nil, fmt.Errorf("duplicate link target %s", targets[i].Output)
+		}
+		g.targets[targets[i].Output] = &targets[i]
+	}
+
+	for i := range targets {
+		if _, err := g.link(&targets[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return g.Graph, nil
+}
+
+func absPath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(dir, path)
+}
+
+// sourcePath maps path into {{.SourceDir}} if path is located inside of source root.
+//
+// Returned path is escaped for command templates.
+func (g *generator) sourcePath(dir, path string) (string, bool) {
+	rel, ok := g.RelPath(absPath(dir, path))
+	if !ok {
+		return build.EscapeTemplate(path), false
+	}
+	if rel == "." {
+		return "{{.SourceDir}}", true
+	}
+	return "{{.SourceDir}}/" + build.EscapeTemplate(rel), true
+}
+
+func (g *generator) findHeaders() ([]string, error) {
+	var headers []string
+	err := filepath.WalkDir(g.config.SourceRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !headerExts[filepath.Ext(path)] {
+			return nil
+		}
+
+		rel, _ := g.RelPath(path)
+		headers = append(headers, rel)
+		return nil
+	})
+	return headers, err
+}
+
+// scanHeaders runs preprocessor and returns headers included by translation unit.
+func (g *generator) scanHeaders(cmd *CompileCommand, args []string) ([]string, error) {
+	var scanArgs []string
+	for i := 1; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-c":
+		case arg == "-o":
+			i++
+		case strings.HasPrefix(arg, "-o"):
+		default:
+			if takesArg, ok := depFileFlags[arg]; ok {
+				if takesArg {
+					i++
+				}
+				continue
+			}
+			scanArgs = append(scanArgs, arg)
+		}
+	}
+	scanArgs = append(scanArgs, "-MM")
+
+	var stdout, stderr bytes.Buffer
+	scan := exec.Command(args[0], scanArgs...)
+	scan.Dir = cmd.Directory
+	scan.Stdout = &stdout
+	scan.Stderr = &stderr
+	if err := scan.Run(); err != nil {
+		return nil, fmt.Errorf("error scanning headers of %s: %w: %s", cmd.File, err, stderr.Bytes())
+	}
+
+	// Output has form of make rule: "a.o: a.c include/a.h \".
+	rule := strings.ReplaceAll(stdout.String(), "\\\n", " ")
+	_, prereqs, ok := strings.Cut(rule, ":")
+	if !ok {
+		return nil, fmt.Errorf("unexpected output of header scan for %s: %q", cmd.File, rule)
+	}
+
+	source := absPath(cmd.Directory, cmd.File)
+
+	var headers []string
+	s := bufio.NewScanner(strings.NewReader(prereqs))
+	s.Split(bufio.ScanWords)
+	for s.Scan() {
+		header := absPath(cmd.Directory, s.Text())
+		if header == source {
+			continue
+		}
+
+		if rel, ok := g.RelPath(header); ok {
+			headers = append(headers, rel)
+		}
+	}
+	return headers, nil
+}
+
+func (g *generator) compile(cmd *CompileCommand) error {
+	args, err := cmd.Args()
+	if err != nil {
+		return err
+	}
+
+	source := absPath(cmd.Directory, cmd.File)
+	sourceRel, ok := g.RelPath(source)
+	if !ok {
+		return fmt.Errorf("source file %s is outside of source root", source)
+	}
+	if _, ok := g.objects[source]; ok {
+		return fmt.Errorf("duplicate compile command for %s", cmd.File)
+	}
+
+	object := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source)) + ".o"
+	outputPath := "{{.OutputDir}}/" + build.EscapeTemplate(object)
+
+	rewritten := []string{build.EscapeTemplate(args[0])}
+	hasOutput := false
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+
+		if takesArg, ok := depFileFlags[arg]; ok {
+			if takesArg {
+				i++
+			}
+			continue
+		}
+
+		if strings.HasPrefix(arg, "-o") {
+			rewritten = append(rewritten, "-o", outputPath)
+			hasOutput = true
+			if arg == "-o" {
+				i++
+			}
+			continue
+		}
+
+		if pathFlag(arg) && i+1 < len(args) {
+			path, _ := g.sourcePath(cmd.Directory, args[i+1])
+			rewritten = append(rewritten, arg, path)
+			i++
+			continue
+		}
+
+		if flag, value, ok := gluedPathFlag(arg); ok {
+			path, _ := g.sourcePath(cmd.Directory, value)
+			rewritten = append(rewritten, flag+path)
+			continue
+		}
+
+		if !strings.HasPrefix(arg, "-") {
+			if _, err := os.Stat(absPath(cmd.Directory, arg)); err == nil {
+				path, _ := g.sourcePath(cmd.Directory, arg)
+				rewritten = append(rewritten, path)
+				continue
+			}
+		}
+		rewritten = append(rewritten, build.EscapeTemplate(arg))
+	}
+	if !hasOutput {
+		rewritten = append(rewritten, "-o", outputPath)
+	}
+
+	job := build.Job{
+		Name: "compile " + sourceRel,
+		Cmds: []build.Cmd{{Exec: rewritten}},
+	}
+
+	headers := g.headers
+	if g.config.ScanHeaders {
+		if headers, err = g.scanHeaders(cmd, args); err != nil {
+			return err
+		}
+	}
+
+	var inputs []build.ID
+	for _, rel := range append([]string{sourceRel}, headers...) {
+		if err := g.AddInput(&job, &inputs, rel); err != nil {
+			return err
+		}
+	}
+
+	g.objects[source] = compiled{
+		id:       g.AddJob(job, inputs),
+		object:   object,
+		compiler: args[0],
+	}
+	return nil
+}
+
+func pathFlag(arg string) bool {
+	for _, flag := range pathFlags {
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func gluedPathFlag(arg string) (flag, value string, ok bool) {
+	for _, flag := range pathFlags {
+		if strings.HasPrefix(arg, flag) && len(arg) > len(flag) {
+			return flag, arg[len(flag):], true
+		}
+	}
+	return "", "", false
+}
+
+func escapeArgs(args []string) []string {
+	escaped := make([]string, 0, len(args))
+	for _, arg := range args {
+		escaped = append(escaped, build.EscapeTemplate(arg))
+	}
+	return escaped
+}
+
+func depRef(id build.ID) string {
+	return fmt.Sprintf("{{index .Deps %q}}", id.String())
+}
+
+func (g *generator) link(target *LinkTarget) (build.ID, error) {
+	if id, ok := g.linked[target.Output]; ok {
+		return id, nil
+	}
+	if g.visiting[target.Output] {
+		return build.ID{}, fmt.Errorf("link target %s depends on itself", target.Output)
+	}
+	g.visiting[target.Output] = true
+	defer delete(g.visiting, target.Output)
+
+	if len(target.Sources) == 0 {
+		return build.ID{}, fmt.Errorf("link target %s has no sources", target.Output)
+	}
+
+	job := build.Job{Name: "link " + target.Output}
+
+	var objects []string
+	var compiler string
+	for _, source := range target.Sources {
+		obj, ok := g.objects[absPath(g.config.SourceRoot, source)]
+		if !ok {
+			return build.ID{}, fmt.Errorf("link target %s: no compile command for %s", target.Output, source)
+		}
+
+		buildgen.AddDep(&job, obj.id)
+		objects = append(objects, depRef(obj.id)+"/"+build.EscapeTemplate(obj.object))
+		if compiler == "" {
+			compiler = obj.compiler
+		}
+	}
+
+	var libs []string
+	for _, name := range target.Deps {
+		dep, ok := g.targets[name]
+		if !ok {
+			return build.ID{}, fmt.Errorf("link target %s depends on unknown target %s", target.Output, name)
+		}
+
+		id, err := g.link(dep)
+		if err != nil {
+			return build.ID{}, err
+		}
+
+		buildgen.AddDep(&job, id)
+		libs = append(libs, depRef(id)+"/"+build.EscapeTemplate(dep.Output))
+	}
+
+	output := "{{.OutputDir}}/" + build.EscapeTemplate(target.Output)
+
+	var args []string
+	switch target.Kind {
+	case KindStatic:
+		args = append([]string{"ar", "rcs", output}, objects...)
+
+	case KindExe, KindShared, "":
+		args = append(args, escapeArgs(target.Linker)...)
+		if len(args) == 0 {
+			args = append(args, build.EscapeTemplate(compiler))
+		}
+		if target.Kind == KindShared {
+			args = append(args, "-shared")
+		}
+		args = append(args, "-o", output)
+		args = append(args, objects...)
+		args = append(args, libs...)
+		args = append(args, escapeArgs(target.Flags)...)
+
+	default:
+		return build.ID{}, fmt.Errorf("link target %s has unknown kind %q", target.Output, target.Kind)
+	}
+
+	job.Cmds = []build.Cmd{{Exec: args}}
+
+	id := g.AddJob(job, nil)
+	g.linked[target.Output] = id
+	return id, nil
+}
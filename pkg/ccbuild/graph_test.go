@@ -0,0 +1,133 @@
+package ccbuild_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build/buildtest"
+	"gitlab.com/slon/shad-go/distbuild/pkg/ccbuild"
+)
+
+func findJob(t *testing.T, graph *build.Graph, name string) build.Job {
+	for _, job := range graph.Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+
+	t.Fatalf("job %q not found", name)
+	return build.Job{}
+}
+
+func loadFixture(t *testing.T, scanHeaders bool) (*build.Graph, string) {
+	for _, tool := range []string{"gcc", "g++", "ar"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+
+	root, err := filepath.Abs("testdata/greet")
+	require.NoError(t, err)
+
+	cmds, err := ccbuild.ParseCompileCommands(filepath.Join(root, "compile_commands.json"))
+	require.NoError(t, err)
+
+	targets, err := ccbuild.ParseLinkTargets(filepath.Join(root, "link.json"))
+	require.NoError(t, err)
+
+	graph, err := ccbuild.Generate(cmds, targets, ccbuild.Config{SourceRoot: root, ScanHeaders: scanHeaders})
+	require.NoError(t, err)
+	require.NoError(t, graph.Validate())
+	require.Len(t, graph.Jobs, 4)
+
+	return graph, root
+}
+
+func TestGenerate(t *testing.T) {
+	graph, root := loadFixture(t, true)
+
+	compileGreet := findJob(t, graph, "compile src/greet.c")
+	require.Equal(t, []string{"src/greet.c", "include/greet.h"}, compileGreet.Inputs)
+	require.Equal(t, []string{
+		"gcc", "-I{{.SourceDir}}/include", `-DGREETING="Hello, distbuild"`,
+		"-c", "{{.SourceDir}}/src/greet.c", "-o", "{{.OutputDir}}/greet.o",
+	}, compileGreet.Cmds[0].Exec)
+
+	compileMain := findJob(t, graph, "compile src/main.cpp")
+	require.Equal(t, []string{
+		"g++", "-I", "{{.SourceDir}}/include", "-std=c++17",
+		"-c", "{{.SourceDir}}/src/main.cpp", "-o", "{{.OutputDir}}/main.o",
+	}, compileMain.Cmds[0].Exec)
+
+	lib := findJob(t, graph, "link libgreet.a")
+	require.Equal(t, []build.ID{compileGreet.ID}, lib.Deps)
+
+	hello := findJob(t, graph, "link hello")
+	require.Equal(t, []build.ID{compileMain.ID, lib.ID}, hello.Deps)
+
+	result := buildtest.Run(t, graph, root)
+
+	out, err := exec.Command(filepath.Join(result.OutputDir["link hello"], "hello")).CombinedOutput()
+	require.NoError(t, err)
+	require.Equal(t, "Hello, distbuild\n", string(out))
+}
+
+func TestGenerateAllHeaders(t *testing.T) {
+	graph, _ := loadFixture(t, false)
+
+	compileGreet := findJob(t, graph, "compile src/greet.c")
+	require.Equal(t, []string{"src/greet.c", "include/greet.h", "include/unused.h"}, compileGreet.Inputs)
+}
+
+func TestGenerateErrors(t *testing.T) {
+	root := t.TempDir()
+
+	_, err := ccbuild.Generate(
+		[]ccbuild.CompileCommand{{Directory: "/elsewhere", File: "a.c", Command: "cc -c a.c"}},
+		nil,
+		ccbuild.Config{SourceRoot: root},
+	)
+	require.ErrorContains(t, err, "outside of source root")
+
+	_, err = ccbuild.Generate(nil, []ccbuild.LinkTarget{
+		{Output: "a", Sources: []string{"a.c"}},
+	}, ccbuild.Config{SourceRoot: root})
+	require.ErrorContains(t, err, "no compile command for a.c")
+}
+
+func TestGenerateEscaping(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a{{x}}.c"), nil, 0666))
+
+	graph, err := ccbuild.Generate(
+		[]ccbuild.CompileCommand{{
+			Directory: root,
+			File:      "a{{x}}.c",
+			Arguments: []string{"cc", "-DMSG={{.OutputDir}}", "-c", "a{{x}}.c", "-obuild/a.o"},
+		}},
+		[]ccbuild.LinkTarget{{Output: "{{a}}", Sources: []string{"a{{x}}.c"}, Flags: []string{"-Wl,{{x}}"}}},
+		ccbuild.Config{SourceRoot: root},
+	)
+	require.NoError(t, err)
+	require.NoError(t, graph.Validate())
+
+	ctx := build.JobContext{SourceDir: "/src", OutputDir: "/out", Deps: map[build.ID]string{}}
+	for _, job := range graph.Jobs {
+		for _, dep := range job.Deps {
+			ctx.Deps[dep] = "/dep"
+		}
+	}
+
+	compile, err := findJob(t, graph, "compile a{{x}}.c").Cmds[0].Render(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cc", "-DMSG={{.OutputDir}}", "-c", "/src/a{{x}}.c", "-o", "/out/a{{x}}.o"}, compile.Exec)
+
+	link, err := findJob(t, graph, "link {{a}}").Cmds[0].Render(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cc", "-o", "/out/{{a}}", "/dep/a{{x}}.o", "-Wl,{{x}}"}, link.Exec)
+}
@@ -0,0 +1,3 @@
+#pragma once
+
+#define UNUSED 1
@@ -0,0 +1,8 @@
+#include <iostream>
+
+#include "greet.h"
+
+int main() {
+    std::cout << greeting() << std::endl;
+    return 0;
+}
@@ -5,7 +5,9 @@ package client
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"path/filepath"
 
 	"go.uber.org/zap"
@@ -21,6 +23,9 @@ type Client struct {
 	buildClient     *api.BuildClient
 	filecacheClient *filecache.Client
 	sourceDir       string
+	priority        int
+	user            string
+	class           string
 }
 
 func NewClient(
@@ -40,6 +45,17 @@ func NewClient(
 	return &client
 }
 
+// SetPriority sets priority of builds started by the client. See api.BuildRequest.Priority.
+func (c *Client) SetPriority(priority int) {
+	c.priority = priority
+}
+
+// SetUser sets user and class of builds started by the client. See api.BuildRequest.User.
+func (c *Client) SetUser(user, class string) {
+	c.user = user
+	c.class = class
+}
+
 type BuildListener interface {
 	OnJobStdout(jobID build.ID, stdout []byte) error
 	OnJobStderr(jobID build.ID, stderr []byte) error
@@ -48,9 +64,52 @@ type BuildListener interface {
 	OnJobFailed(jobID build.ID, code int, error string) error
 }
 
+// TruncatedOutputListener может дополнительно реализовать BuildListener, чтобы узнавать о джобах,
+// чей вывод не поместился в JobResult. В JobResult в этом случае остаётся только начало вывода,
+// а полный лог можно скачать через Client.FetchLog.
+type TruncatedOutputListener interface {
+	OnJobOutputTruncated(jobID build.ID, stdout, stderr *api.LogRef) error
+}
+
+// CombinedLogListener может дополнительно реализовать BuildListener, чтобы получать общий журнал
+// stdout и stderr джобов, запрошенных с build.Job.CombinedLog.
+type CombinedLogListener interface {
+	OnJobLog(jobID build.ID, log []api.LogLine, truncated bool) error
+}
+
+// UndeclaredOutputsListener может дополнительно реализовать BuildListener, чтобы узнавать о файлах,
+// которые джоб с build.Job.StrictOutputs создал вне объявленных build.Job.Outputs.
+type UndeclaredOutputsListener interface {
+	OnJobUndeclaredOutputs(jobID build.ID, outputs []string) error
+}
+
+// FetchLog downloads full output of the job from the worker that ran it.
+func (c *Client) FetchLog(ctx context.Context, ref *api.LogRef) (io.ReadCloser, error) {
+	url := ref.Worker.String() + "/log?id=" + ref.Job.String() + "&stream=" + ref.Stream
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		_ = rsp.Body.Close()
+		return nil, fmt.Errorf("fetch %s log of job %s: status %s", ref.Stream, ref.Job, rsp.Status)
+	}
+	return rsp.Body, nil
+}
+
 func (c *Client) Build(ctx context.Context, graph build.Graph, lsn BuildListener) error {
 	buildRequest := &api.BuildRequest{
-		Graph: graph,
+		Graph:    graph,
+		Priority: c.priority,
+		User:     c.user,
+		Class:    c.class,
 	}
 	buildStarted, reader, err := c.buildClient.StartBuild(ctx, buildRequest)
 	if err != nil {
@@ -88,37 +147,88 @@ func (c *Client) Build(ctx context.Context, graph build.Graph, lsn BuildListener
 			return err
 		}
 
+		if update.BuildFailed != nil {
+			return errors.New(update.BuildFailed.Error)
+		}
+
+		if output := update.JobOutput; output != nil {
+			if len(output.Stdout) != 0 {
+				if err := lsn.OnJobStdout(output.ID, output.Stdout); err != nil {
+					return err
+				}
+			}
+
+			if len(output.Stderr) != 0 {
+				if err := lsn.OnJobStderr(output.ID, output.Stderr); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
 		if update.JobFinished == nil {
 			continue
 		}
 
-		if update.BuildFailed != nil {
-			err = lsn.OnJobFailed(update.JobFinished.ID, update.JobFinished.ExitCode, update.BuildFailed.Error)
+		result := update.JobFinished
+
+		if len(result.Stdout) != 0 {
+			err = lsn.OnJobStdout(result.ID, result.Stdout)
 			if err != nil {
 				return err
 			}
 		}
 
-		if update.BuildFinished != nil {
-			err = lsn.OnJobFinished(update.JobFinished.ID)
+		if len(result.Stderr) != 0 {
+			err = lsn.OnJobStderr(result.ID, result.Stderr)
 			if err != nil {
 				return err
 			}
 		}
 
-		if update.JobFinished.Stdout != nil {
-			err = lsn.OnJobStdout(update.JobFinished.ID, update.JobFinished.Stdout)
+		if len(result.UndeclaredOutputs) != 0 {
+			c.logger.Warn("job produced undeclared outputs",
+				zap.String("job", result.ID.String()), zap.Strings("outputs", result.UndeclaredOutputs))
+
+			if undeclared, ok := lsn.(UndeclaredOutputsListener); ok {
+				err = undeclared.OnJobUndeclaredOutputs(result.ID, result.UndeclaredOutputs)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if truncated, ok := lsn.(TruncatedOutputListener); ok && (result.StdoutLog != nil || result.StderrLog != nil) {
+			err = truncated.OnJobOutputTruncated(result.ID, result.StdoutLog, result.StderrLog)
 			if err != nil {
 				return err
 			}
 		}
 
-		if update.JobFinished.Stderr != nil {
-			err = lsn.OnJobStderr(update.JobFinished.ID, update.JobFinished.Stderr)
+		if combined, ok := lsn.(CombinedLogListener); ok && (len(result.Log) != 0 || result.LogTruncated) {
+			err = combined.OnJobLog(result.ID, result.Log, result.LogTruncated)
 			if err != nil {
 				return err
 			}
 		}
+
+		if result.Error != nil || result.ExitCode != 0 {
+			var errorText string
+			if result.Error != nil {
+				errorText = *result.Error
+			}
+
+			err = lsn.OnJobFailed(result.ID, result.ExitCode, errorText)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = lsn.OnJobFinished(result.ID)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
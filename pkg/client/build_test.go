@@ -0,0 +1,139 @@
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	mock "gitlab.com/slon/shad-go/distbuild/pkg/api/mock"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/client"
+)
+
+type listener struct {
+	stdout   map[build.ID]string
+	chunks   []string
+	finished []build.ID
+	failed   map[build.ID]string
+	codes    map[build.ID]int
+}
+
+func newListener() *listener {
+	return &listener{
+		stdout: map[build.ID]string{},
+		failed: map[build.ID]string{},
+		codes:  map[build.ID]int{},
+	}
+}
+
+func (l *listener) OnJobStdout(jobID build.ID, stdout []byte) error {
+	l.stdout[jobID] += string(stdout)
+	l.chunks = append(l.chunks, string(stdout))
+	return nil
+}
+
+func (l *listener) OnJobStderr(jobID build.ID, stderr []byte) error {
+	return nil
+}
+
+func (l *listener) OnJobFinished(jobID build.ID) error {
+	l.finished = append(l.finished, jobID)
+	return nil
+}
+
+func (l *listener) OnJobFailed(jobID build.ID, code int, error string) error {
+	l.failed[jobID] = error
+	l.codes[jobID] = code
+	return nil
+}
+
+func newTestClient(t *testing.T, startBuild func(w api.StatusWriter) error) *client.Client {
+	ctrl := gomock.NewController(t)
+	service := mock.NewMockService(ctrl)
+
+	service.EXPECT().StartBuild(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, request *api.BuildRequest, w api.StatusWriter) error {
+			if err := w.Started(&api.BuildStarted{ID: build.ID{'b'}}); err != nil {
+				return err
+			}
+			return startBuild(w)
+		})
+	service.EXPECT().SignalBuild(gomock.Any(), build.ID{'b'}, gomock.Any()).Return(&api.SignalResponse{}, nil)
+
+	log := zaptest.NewLogger(t)
+	mux := http.NewServeMux()
+	api.NewBuildService(log, service).Register(mux)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return client.NewClient(log, server.URL, t.TempDir())
+}
+
+func TestBuildReportsJobResults(t *testing.T) {
+	errorText := "cmd failed"
+	c := newTestClient(t, func(w api.StatusWriter) error {
+		updates := []*api.StatusUpdate{
+			{JobFinished: &api.JobResult{ID: build.ID{'a'}, Stdout: []byte("OK")}},
+			{JobFinished: &api.JobResult{ID: build.ID{'c'}, ExitCode: 2}},
+			{JobFinished: &api.JobResult{ID: build.ID{'d'}, Error: &errorText}},
+			{BuildFinished: &api.BuildFinished{}},
+		}
+		for _, update := range updates {
+			if err := w.Updated(update); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	lsn := newListener()
+	require.NoError(t, c.Build(context.Background(), build.Graph{}, lsn))
+
+	require.Equal(t, []build.ID{{'a'}}, lsn.finished)
+	require.Equal(t, "OK", lsn.stdout[build.ID{'a'}])
+	require.Equal(t, map[build.ID]int{{'c'}: 2, {'d'}: 0}, lsn.codes)
+	require.Equal(t, "cmd failed", lsn.failed[build.ID{'d'}])
+}
+
+func TestBuildStreamsJobOutput(t *testing.T) {
+	c := newTestClient(t, func(w api.StatusWriter) error {
+		updates := []*api.StatusUpdate{
+			{JobOutput: &api.JobOutput{ID: build.ID{'a'}, Stdout: []byte("first\n")}},
+			{JobOutput: &api.JobOutput{ID: build.ID{'a'}, Stdout: []byte("second\n")}},
+			{JobFinished: &api.JobResult{ID: build.ID{'a'}, Stdout: []byte("third\n")}},
+			{BuildFinished: &api.BuildFinished{}},
+		}
+		for _, update := range updates {
+			if err := w.Updated(update); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	lsn := newListener()
+	require.NoError(t, c.Build(context.Background(), build.Graph{}, lsn))
+
+	require.Equal(t, []string{"first\n", "second\n", "third\n"}, lsn.chunks)
+	require.Equal(t, "first\nsecond\nthird\n", lsn.stdout[build.ID{'a'}])
+	require.Equal(t, []build.ID{{'a'}}, lsn.finished)
+}
+
+func TestBuildFailed(t *testing.T) {
+	c := newTestClient(t, func(w api.StatusWriter) error {
+		return w.Updated(&api.StatusUpdate{BuildFailed: &api.BuildFailed{Error: "coordinator is stopping"}})
+	})
+
+	lsn := newListener()
+	err := c.Build(context.Background(), build.Graph{}, lsn)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "coordinator is stopping")
+	require.Empty(t, lsn.finished)
+}
@@ -4,7 +4,10 @@ package dist
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
@@ -20,27 +23,105 @@ type Coordinator struct {
 	logger    *zap.Logger
 	fileCache *filecache.Cache
 	mux       *http.ServeMux
+	config    Config
 
-	sched *scheduler.Scheduler
+	sched   *scheduler.Scheduler
+	history *jobHistory
+
+	// uploads хранит для каждой начатой сборки канал, который закрывается, когда клиент загрузил исходники.
+	uploads      map[build.ID]chan struct{}
+	uploadsMutex sync.Mutex
+
+	// watchers хранит для каждого джоба сборки, которым нужно пересылать его вывод. Защищён innerMutex.
+	watchers map[build.ID][]*outputWatcher
 
-	waitSignal sync.WaitGroup
 	innerMutex sync.Mutex
 }
 
-var defaultConfig = scheduler.Config{
-	CacheTimeout: time.Millisecond * 10,
-	DepsTimeout:  time.Millisecond * 100,
+// outputWatcher пересылает сборке вывод текущей попытки джоба, пока она выполняется.
+//
+// Сборке пересылается вывод только одной попытки. Если джоб завершила другая попытка (спекулятивная
+// копия или перезапуск), в JobFinished уходит её полный вывод.
+type outputWatcher struct {
+	updates *statusQueue
+	attempt *scheduler.PendingJob
+
+	// streamed задаёт попытку, чей вывод уже переслан сборке, а stdout и stderr - сколько байт.
+	streamed       *scheduler.PendingJob
+	stdout, stderr int
+}
+
+// result returns result of the finished attempt without the output already forwarded to the build.
+//
+// Must be called with innerMutex held.
+func (w *outputWatcher) result() *api.JobResult {
+	res := w.attempt.Result
+	if w.streamed != w.attempt || w.attempt.CompletedBy != w.attempt.Worker {
+		return res
+	}
+
+	rest := *res
+	rest.Stdout = res.Stdout[min(w.stdout, len(res.Stdout)):]
+	rest.Stderr = res.Stderr[min(w.stderr, len(res.Stderr)):]
+	return &rest
+}
+
+// Config задаёт настройки координатора.
+type Config struct {
+	Scheduler scheduler.Config
+
+	// DefaultJobTimeout ограничивает время работы джобов, у которых не задан Job.Timeout.
+	//
+	// Нулевое значение снимает ограничение.
+	DefaultJobTimeout time.Duration
+
+	// JobRetries задаёт, сколько раз джоб перезапускается после сбоев инфраструктуры
+	// (см. api.JobResult.Retryable), прежде чем сборка завершится с ошибкой.
+	JobRetries int
+
+	// Speculation включает спекулятивный запуск копий медленных джобов. Если nil, копии не запускаются.
+	Speculation *SpeculationConfig
+}
+
+// SpeculationConfig задаёт, какие джобы считаются отстающими.
+//
+// Джоб отстаёт, если выполняется дольше медианы своих прошлых запусков, умноженной на Slowdown,
+// но не меньше MinDuration. Для такого джоба координатор запускает копию на другом воркере и
+// использует результат той попытки, которая завершится первой. Джобы без истории запусков не копируются.
+type SpeculationConfig struct {
+	Slowdown    float64
+	MinDuration time.Duration
+}
+
+var DefaultConfig = Config{
+	Scheduler: scheduler.Config{
+		CacheTimeout: time.Millisecond * 10,
+		DepsTimeout:  time.Millisecond * 100,
+	},
+	JobRetries: 3,
 }
 
 func NewCoordinator(
 	log *zap.Logger,
 	fileCache *filecache.Cache,
+) *Coordinator {
+	return NewCoordinatorWithConfig(log, fileCache, DefaultConfig)
+}
+
+func NewCoordinatorWithConfig(
+	log *zap.Logger,
+	fileCache *filecache.Cache,
+	config Config,
 ) *Coordinator {
 	var coord Coordinator
 	coord.logger = log
 	coord.fileCache = fileCache
 	coord.mux = http.NewServeMux()
-	coord.sched = scheduler.NewScheduler(log, defaultConfig)
+	coord.config = config
+	coord.sched = scheduler.NewScheduler(log, config.Scheduler)
+	coord.history = newJobHistory()
+	coord.uploads = make(map[build.ID]chan struct{})
+	coord.watchers = make(map[build.ID][]*outputWatcher)
 
 	heartbeatHandler := api.NewHeartbeatHandler(log, &coord)
 	buildHandler := api.NewBuildService(log, &coord)
@@ -49,6 +130,7 @@ func NewCoordinator(
 	heartbeatHandler.Register(coord.mux)
 	buildHandler.Register(coord.mux)
 	filecacheHandler.Register(coord.mux)
+	coord.mux.HandleFunc("GET /shares", coord.serveShares)
 
 	return &coord
 }
@@ -58,8 +140,12 @@ func (c *Coordinator) Stop() {
 }
 
 func (c *Coordinator) StartBuild(ctx context.Context, request *api.BuildRequest, w api.StatusWriter) error {
+	if err := request.Graph.Validate(); err != nil {
+		c.logger.Error("rejecting invalid build graph", zap.Error(err))
+		return fmt.Errorf("invalid build graph: %w", err)
+	}
+
 	jobs := build.TopSort(request.Graph.Jobs)
-	graph := request.Graph
 
 	missed := make([]build.ID, 0)
 	for id := range request.Graph.SourceFiles {
@@ -72,85 +158,371 @@ func (c *Coordinator) StartBuild(ctx context.Context, request *api.BuildRequest,
 		}
 	}
 
-	c.waitSignal.Add(1)
+	buildID := build.NewID()
+	uploaded := make(chan struct{})
+
+	c.uploadsMutex.Lock()
+	c.uploads[buildID] = uploaded
+	c.uploadsMutex.Unlock()
+
+	defer func() {
+		c.uploadsMutex.Lock()
+		delete(c.uploads, buildID)
+		c.uploadsMutex.Unlock()
+	}()
+
 	err := w.Started(&api.BuildStarted{
-		ID:           build.NewID(),
+		ID:           buildID,
 		MissingFiles: missed,
 	})
 
-	c.waitSignal.Wait()
+	select {
+	case <-uploaded:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for i := range jobs {
+		if err := c.sched.CheckPlacement(&jobs[i]); err != nil {
+			c.logger.Error("rejecting unplaceable job", zap.Error(err))
+			return err
+		}
+	}
+
+	criticalPath := build.CriticalPath(jobs, c.history.estimate)
+
+	owner := scheduler.Owner{Build: buildID, User: request.User, Class: request.Class}
+	defer c.sched.FinishBuild(buildID)
+
+	// Вывод и результаты джобов пересылаются клиенту через updates, чтобы Heartbeat не ждал клиента
+	// под innerMutex. StartBuild не должен вернуться, пока они не отправлены.
+	updates := newStatusQueue(w)
+	defer updates.close()
+
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	buildCtx, cancelBuild := context.WithCancel(ctx)
+	defer cancelBuild()
 
+	// Джоб отправляется в шедулер, как только завершились все его зависимости. Поэтому в очереди
+	// одновременно находятся все готовые к запуску джобы, и шедулер выбирает между ними по приоритету.
+	done := make(map[build.ID]chan struct{}, len(jobs))
 	for _, job := range jobs {
-		var jobSpec api.JobSpec
-		jobSpec.Job = job
-		jobSpec.SourceFiles = make(map[build.ID]string)
-		for id, path := range graph.SourceFiles {
-			for _, input := range job.Inputs {
-				if input == path {
-					jobSpec.SourceFiles[id] = path
+		done[job.ID] = make(chan struct{})
+	}
+
+	names := make(map[build.ID]string, len(jobs))
+	for _, job := range jobs {
+		names[job.ID] = job.Name
+	}
+
+	finished := make(chan *outputWatcher)
+	for _, job := range jobs {
+		running.Add(1)
+		go func(job build.Job) {
+			defer running.Done()
+
+			for _, dep := range job.Deps {
+				select {
+				case <-done[dep]:
+				case <-buildCtx.Done():
+					return
+				}
+			}
+
+			pending := c.sched.ScheduleJob(c.jobSpec(&job, &request.Graph, names), owner, scheduler.Priority{
+				Build:        request.Priority,
+				CriticalPath: criticalPath[job.ID],
+			})
+
+			watcher := c.watchOutput(job.ID, pending, updates)
+			defer c.unwatchOutput(job.ID, watcher)
+
+			for attempt := 0; ; attempt++ {
+				if !c.waitJob(buildCtx, pending) {
+					return
+				}
+
+				if !pending.Result.Retryable || attempt >= c.config.JobRetries {
 					break
 				}
+
+				c.logger.Warn("retrying job after infrastructure failure",
+					zap.String("job", job.ID.String()),
+					zap.String("worker", pending.Worker.String()),
+					zap.Int("attempt", attempt+1),
+					zap.Stringp("error", pending.Result.Error))
+				pending = c.sched.RetryJob(pending)
+
+				c.innerMutex.Lock()
+				watcher.attempt = pending
+				c.innerMutex.Unlock()
 			}
-		}
-		
-		jobSpec.Artifacts = make(map[build.ID]api.WorkerID)
-		for _, depID := range job.Deps {
-			workerID, _ := c.sched.LocateArtifact(depID)
-			jobSpec.Artifacts[depID] = workerID
-		}
 
-		pending := c.sched.ScheduleJob(&jobSpec)
+			select {
+			case finished <- watcher:
+			case <-buildCtx.Done():
+			}
+		}(job)
+	}
 
+	for range jobs {
+		var watcher *outputWatcher
 		select {
-		case <-pending.Finished:
+		case watcher = <-finished:
 		case <-ctx.Done():
 			c.logger.Sugar().Infof("context done while job is pending")
 			return ctx.Err()
 		}
 
 		c.innerMutex.Lock()
-		_ = w.Updated(&api.StatusUpdate{
-			JobFinished:   pending.Result,
-			BuildFinished: &api.BuildFinished{},
+		pending := watcher.attempt
+		updates.push(&api.StatusUpdate{
+			JobFinished: watcher.result(),
 		})
 		c.innerMutex.Unlock()
+
+		job := &pending.Job.Job
+
+		if pending.Result.Error == nil && pending.Result.Usage.WallTime != 0 {
+			c.history.add(job.Name, pending.Result.Usage.WallTime)
+		}
+
+		if pending.Result.Error != nil || pending.Result.ExitCode != 0 {
+			c.logger.Info("job failed, stopping build", zap.String("job", job.ID.String()))
+			return jobError(job, pending.Result)
+		}
+
+		close(done[job.ID])
 	}
 
 	if err != nil {
 		return err
 	}
-	return nil
+
+	// Вывод джобов ещё может стоять в updates, BuildFinished должен быть последним.
+	cancelBuild()
+	running.Wait()
+	updates.close()
+	return w.Updated(&api.StatusUpdate{BuildFinished: &api.BuildFinished{}})
+}
+
+// jobError describes failed job. StartBuild returns it, so that the client receives BuildFailed.
+func jobError(job *build.Job, res *api.JobResult) error {
+	if res.Error != nil {
+		return fmt.Errorf("job %s (%s) failed: %s", job.ID, job.Name, *res.Error)
+	}
+	return fmt.Errorf("job %s (%s) exited with code %d", job.ID, job.Name, res.ExitCode)
+}
+
+// waitJob waits until the job finishes and starts its speculative copy if the job runs too long.
+//
+// It returns false if ctx is done first.
+func (c *Coordinator) waitJob(ctx context.Context, pending *scheduler.PendingJob) bool {
+	if threshold, ok := c.stragglerThreshold(&pending.Job.Job); ok {
+		select {
+		case <-pending.Picked:
+		case <-pending.Finished:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+
+		timer := time.NewTimer(threshold)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			c.logger.Info("job runs too long, starting speculative copy",
+				zap.String("job", pending.Job.ID.String()),
+				zap.String("worker", pending.Worker.String()),
+				zap.Duration("threshold", threshold))
+			c.sched.SpeculateJob(pending)
+		case <-pending.Finished:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	select {
+	case <-pending.Finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *Coordinator) stragglerThreshold(job *build.Job) (time.Duration, bool) {
+	if c.config.Speculation == nil {
+		return 0, false
+	}
+
+	median, ok := c.history.median(job.Name)
+	if !ok {
+		return 0, false
+	}
+
+	threshold := time.Duration(float64(median) * c.config.Speculation.Slowdown)
+	if threshold < c.config.Speculation.MinDuration {
+		threshold = c.config.Speculation.MinDuration
+	}
+	return threshold, true
+}
+
+func (c *Coordinator) watchOutput(id build.ID, pending *scheduler.PendingJob, updates *statusQueue) *outputWatcher {
+	c.innerMutex.Lock()
+	defer c.innerMutex.Unlock()
+
+	watcher := &outputWatcher{updates: updates, attempt: pending}
+	c.watchers[id] = append(c.watchers[id], watcher)
+	return watcher
+}
+
+func (c *Coordinator) unwatchOutput(id build.ID, watcher *outputWatcher) {
+	c.innerMutex.Lock()
+	defer c.innerMutex.Unlock()
+
+	watchers := slices.DeleteFunc(c.watchers[id], func(w *outputWatcher) bool { return w == watcher })
+	if len(watchers) == 0 {
+		delete(c.watchers, id)
+	} else {
+		c.watchers[id] = watchers
+	}
+}
+
+// forwardOutput sends output of the running job to the builds waiting for it.
+//
+// Output of speculative copies and of retries after the output of the first attempt was forwarded
+// is not, so that the build sees output of a single attempt. Must be called with innerMutex held,
+// output is only queued and is sent to the client after the lock is released.
+func (c *Coordinator) forwardOutput(workerID api.WorkerID, output *api.JobOutput) {
+	for _, watcher := range c.watchers[output.ID] {
+		select {
+		case <-watcher.attempt.Picked:
+		default:
+			continue
+		}
+
+		if watcher.attempt.Worker != workerID {
+			continue
+		}
+
+		if watcher.streamed == nil {
+			watcher.streamed = watcher.attempt
+		} else if watcher.streamed != watcher.attempt {
+			continue
+		}
+
+		watcher.stdout += len(output.Stdout)
+		watcher.stderr += len(output.Stderr)
+		watcher.updates.push(&api.StatusUpdate{JobOutput: output})
+	}
+}
+
+func (c *Coordinator) jobSpec(job *build.Job, graph *build.Graph, names map[build.ID]string) *api.JobSpec {
+	var jobSpec api.JobSpec
+	jobSpec.Job = *job
+	if jobSpec.Timeout == 0 {
+		jobSpec.Timeout = c.config.DefaultJobTimeout
+	}
+	jobSpec.SourceFiles = make(map[build.ID]string)
+	for id, path := range graph.SourceFiles {
+		for _, input := range job.Inputs {
+			if input == path {
+				jobSpec.SourceFiles[id] = path
+				break
+			}
+		}
+	}
+
+	jobSpec.Artifacts = make(map[build.ID]api.WorkerID)
+	jobSpec.ArtifactSources = make(map[build.ID][]api.WorkerID)
+	jobSpec.DepNames = make(map[build.ID]string)
+	for _, depID := range job.Deps {
+		holders := c.sched.ArtifactHolders(depID)
+
+		var workerID api.WorkerID
+		if len(holders) != 0 {
+			workerID = holders[0]
+		}
+		jobSpec.Artifacts[depID] = workerID
+		jobSpec.ArtifactSources[depID] = holders
+		jobSpec.DepNames[depID] = names[depID]
+	}
+
+	return &jobSpec
 }
 
 func (c *Coordinator) SignalBuild(ctx context.Context, buildID build.ID, signal *api.SignalRequest) (*api.SignalResponse, error) {
-	c.waitSignal.Done()
+	c.uploadsMutex.Lock()
+	defer c.uploadsMutex.Unlock()
+
+	uploaded, ok := c.uploads[buildID]
+	if !ok {
+		return nil, fmt.Errorf("build %s is not waiting for upload", buildID)
+	}
+
+	select {
+	case <-uploaded:
+	default:
+		close(uploaded)
+	}
 	return &api.SignalResponse{}, nil
 }
 
+// serveShares reports how workers are shared between running builds.
+func (c *Coordinator) serveShares(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.sched.Shares()); err != nil {
+		c.logger.Error("failed to write shares", zap.Error(err))
+	}
+}
+
 func (c *Coordinator) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
 	c.innerMutex.Lock()
+	for i := range req.Output {
+		c.forwardOutput(req.WorkerID, &req.Output[i])
+	}
+	// Источники артефактов обновляются раньше результатов: следующие джобы сразу получат новые адреса.
+	for _, id := range req.AddedArtifacts {
+		c.sched.AddArtifact(id, req.WorkerID)
+	}
+	for _, bad := range req.BadArtifactSources {
+		c.logger.Warn("artifact download failed",
+			zap.String("artifact", bad.ID.String()), zap.String("source", bad.Worker.String()))
+		c.sched.RemoveArtifact(bad.ID, bad.Worker)
+	}
 	for _, finishedJob := range req.FinishedJob {
 		c.sched.OnJobComplete(req.WorkerID, finishedJob.ID, &finishedJob)
 	}
 	c.innerMutex.Unlock()
 
-	var resp *api.HeartbeatResponse
+	for _, id := range req.CanceledJobs {
+		c.logger.Debug("worker canceled job", zap.String("worker", req.WorkerID.String()), zap.String("job", id.String()))
+	}
+
+	worker := scheduler.WorkerInfo{
+		ID:     req.WorkerID,
+		Total:  req.TotalResources,
+		Free:   req.FreeResources,
+		Labels: req.Labels,
+	}
+	c.sched.RegisterWorker(worker)
+
+	resp := &api.HeartbeatResponse{
+		JobsToRun: make(map[build.ID]api.JobSpec),
+	}
 	if req.FreeSlots > 0 {
-		job := c.sched.PickJob(ctx, req.WorkerID)
+		job := c.sched.PickJob(ctx, worker)
 
 		if job != nil {
-			resp = &api.HeartbeatResponse{
-				JobsToRun: map[build.ID]api.JobSpec{
-					job.Job.ID: *job.Job,
-				},
-			}
-		}
-	} else {
-		resp = &api.HeartbeatResponse{
-			JobsToRun: make(map[build.ID]api.JobSpec),
+			resp.JobsToRun[job.Job.ID] = *job.Job
 		}
 	}
 
+	resp.JobsToCancel = c.sched.TakeCancellations(req.WorkerID)
 	return resp, nil
 }
 
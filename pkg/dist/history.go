@@ -0,0 +1,68 @@
+//go:build !solution
+
+package dist
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// historySize задаёт, сколько последних запусков каждого джоба помнит координатор.
+const historySize = 16
+
+// defaultJobDuration используется как оценка длительности джоба, который ещё ни разу не запускался.
+const defaultJobDuration = time.Second
+
+// jobHistory хранит длительности последних запусков джобов.
+//
+// Джобы различаются по имени, а не по ID, потому что ID меняется при любом изменении входов,
+// а длительность обычно остаётся прежней. Джобы без имени не различить между собой, поэтому
+// их длительности не запоминаются.
+type jobHistory struct {
+	mutex     sync.Mutex
+	durations map[string][]time.Duration
+}
+
+func newJobHistory() *jobHistory {
+	return &jobHistory{durations: make(map[string][]time.Duration)}
+}
+
+func (h *jobHistory) add(name string, d time.Duration) {
+	if name == "" {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	l := append(h.durations[name], d)
+	if len(l) > historySize {
+		l = l[len(l)-historySize:]
+	}
+	h.durations[name] = l
+}
+
+// median returns median duration of the recent runs of the job.
+func (h *jobHistory) median(name string) (time.Duration, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	l := h.durations[name]
+	if len(l) == 0 {
+		return 0, false
+	}
+
+	sorted := append([]time.Duration{}, l...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2], true
+}
+
+func (h *jobHistory) estimate(job *build.Job) time.Duration {
+	if d, ok := h.median(job.Name); ok {
+		return d
+	}
+	return defaultJobDuration
+}
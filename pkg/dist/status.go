@@ -0,0 +1,76 @@
+//go:build !solution
+
+package dist
+
+import (
+	"sync"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+)
+
+// statusQueue пересылает обновления статуса сборки клиенту из отдельной горутины.
+//
+// push не блокируется, поэтому обновления можно ставить в очередь под innerMutex, не дожидаясь
+// медленного клиента. Обновления отправляются в порядке вызовов push.
+type statusQueue struct {
+	w api.StatusWriter
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	updates []*api.StatusUpdate
+	closed  bool
+
+	// done закрывается, когда все обновления отправлены и горутина завершилась.
+	done chan struct{}
+}
+
+func newStatusQueue(w api.StatusWriter) *statusQueue {
+	q := &statusQueue{w: w, done: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mutex)
+	go q.run()
+	return q
+}
+
+// push appends update to the queue. Updates pushed after close are dropped.
+func (q *statusQueue) push(update *api.StatusUpdate) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.updates = append(q.updates, update)
+	q.cond.Signal()
+}
+
+// close waits until all pushed updates are sent. It is safe to call close more than once.
+func (q *statusQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.cond.Signal()
+	q.mutex.Unlock()
+
+	<-q.done
+}
+
+func (q *statusQueue) run() {
+	defer close(q.done)
+
+	for {
+		q.mutex.Lock()
+		for len(q.updates) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.updates) == 0 {
+			q.mutex.Unlock()
+			return
+		}
+
+		update := q.updates[0]
+		q.updates[0] = nil
+		q.updates = q.updates[1:]
+		q.mutex.Unlock()
+
+		_ = q.w.Updated(update)
+	}
+}
@@ -0,0 +1,492 @@
+package gobuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build/buildgen"
+)
+
+// Config задаёт параметры генератора графа.
+type Config struct {
+	// SourceRoot задаёт директорию, которую клиент использует как директорию с исходным кодом.
+	//
+	// Обычно это корень модуля. Файлы пакетов вне SourceRoot (например, из кеша модулей) не загружаются
+	// как исходники, их содержимое записывается прямо в граф.
+	SourceRoot string
+
+	// Vet добавляет в граф vet джоб для каждого пакета.
+	Vet bool
+
+	// Test добавляет в граф джоб, запускающий тесты, для каждого пакета с тестами.
+	Test bool
+
+	// TestArgs задаёт аргументы запуска тестовых бинарей. Например, -test.v.
+	TestArgs []string
+}
+
+const (
+	pkgArchive = "_pkg_.a"
+	importcfg  = "importcfg"
+)
+
+type generator struct {
+	*buildgen.Builder
+
+	config Config
+
+	pkgs     map[string]*Package
+	compiled map[string]build.ID
+
+	// stdlib задаёт джоб, собирающий пакеты стандартной библиотеки.
+	stdlib build.ID
+}
+
+// Generate converts output of `go list -deps -test -json` into a build graph.
+//
+// Graph contains compile job for every package outside of the standard library, one job that
+// builds all used standard library packages, link job for every main package and, depending
+// on config, vet and test jobs.
+func Generate(pkgs []*Package, config Config) (*build.Graph, error) {
+	root, err := filepath.Abs(config.SourceRoot)
+	if err != nil {
+		return nil, err
+	}
+	config.SourceRoot = root
+
+	g := &generator{
+		Builder:  buildgen.NewBuilder(root),
+		config:   config,
+		pkgs:     map[string]*Package{},
+		compiled: map[string]build.ID{},
+	}
+
+	var std []string
+	for _, p := range pkgs {
+		if p.Error != nil {
+			return nil, fmt.Errorf("package %s: %s", p.ImportPath, p.Error.Err)
+		}
+		if p.Incomplete {
+			return nil, fmt.Errorf("package %s: incomplete, some of its dependencies failed to load", p.ImportPath)
+		}
+		g.pkgs[p.ImportPath] = p
+
+		if p.Standard && p.ImportPath != "unsafe" {
+			std = append(std, p.ImportPath)
+		}
+	}
+
+	if len(std) != 0 {
+		g.stdlib = g.stdlibJob(std)
+	}
+
+	for _, p := range pkgs {
+		if p.Standard {
+			continue
+		}
+
+		compileID, err := g.compile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Name == "main" {
+			linkID, err := g.link(p, compileID)
+			if err != nil {
+				return nil, err
+			}
+
+			if config.Test && p.ForTest == "" && strings.HasSuffix(p.ImportPath, ".test") {
+				if err := g.test(p, linkID); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if config.Vet && p.ForTest == "" && !strings.HasSuffix(p.ImportPath, ".test") {
+			if err := g.vet(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return g.Graph, nil
+}
+
+// pkgPath returns path of the package as it is seen by compiler and linker.
+func pkgPath(p *Package) string {
+	importPath, _, _ := strings.Cut(p.ImportPath, " ")
+	return importPath
+}
+
+func depRef(id build.ID) string {
+	return "{{" + depExpr(id) + "}}"
+}
+
+// depExpr returns template expression with the output directory of the dependency.
+func depExpr(id build.ID) string {
+	return fmt.Sprintf("(index .Deps %q)", id.String())
+}
+
+// stdlibJob returns job that builds archives of the standard library packages.
+//
+// Sources of the standard library come with the toolchain, so the job asks go command of the worker
+// to build the packages and copies their archives into the output directory as <import path>.a.
+func (g *generator) stdlibJob(pkgs []string) build.ID {
+	sort.Strings(pkgs)
+
+	const script = `set -e
+out=$1
+shift
+go list -export -f '{{if .Export}}{{.ImportPath}} {{.Export}}{{end}}' "$@" > "$out/export.txt"
+while read -r pkg file; do
+	mkdir -p "$out/$(dirname "$pkg")"
+	cp "$file" "$out/$pkg.a"
+done < "$out/export.txt"
+`
+
+	job := build.Job{
+		Name: "stdlib",
+		Cmds: []build.Cmd{
+			{
+				Exec:             append([]string{"sh", "-c", build.EscapeTemplate(script), "stdlib", "{{.OutputDir}}"}, pkgs...),
+				WorkingDirectory: "{{.TmpDir}}",
+			},
+		},
+	}
+
+	return g.AddJob(job, nil)
+}
+
+// packageFile returns job that builds the package and name of the archive inside of its output,
+// adding a dependency to job. ok is false for packages without archive, like unsafe.
+func (g *generator) packageFile(job *build.Job, resolved string) (id build.ID, name string, ok bool, err error) {
+	dep, found := g.pkgs[resolved]
+	if !found {
+		return build.ID{}, "", false, fmt.Errorf("package %s is missing from go list output", resolved)
+	}
+
+	if dep.Standard {
+		if resolved == "unsafe" {
+			return build.ID{}, "", false, nil
+		}
+
+		buildgen.AddDep(job, g.stdlib)
+		return g.stdlib, pkgPath(dep) + ".a", true, nil
+	}
+
+	id, err = g.compile(dep)
+	if err != nil {
+		return build.ID{}, "", false, err
+	}
+
+	buildgen.AddDep(job, id)
+	return id, pkgArchive, true, nil
+}
+
+// usesEmbed reports whether package or its tests embed files with //go:embed.
+func usesEmbed(p *Package) bool {
+	return len(p.EmbedPatterns) != 0 || len(p.EmbedFiles) != 0 ||
+		len(p.TestEmbedPatterns) != 0 || len(p.XTestEmbedPatterns) != 0
+}
+
+func (g *generator) compile(p *Package) (build.ID, error) {
+	if id, ok := g.compiled[p.ImportPath]; ok {
+		return id, nil
+	}
+
+	if len(p.CgoFiles) != 0 || len(p.SFiles) != 0 || usesEmbed(p) {
+		return build.ID{}, fmt.Errorf("package %s: cgo, assembly and embed are not supported", p.ImportPath)
+	}
+
+	job := build.Job{Name: "compile " + p.ImportPath}
+	var inputs []build.ID
+
+	sourceImport := map[string]string{}
+	for from, to := range p.ImportMap {
+		sourceImport[to] = from
+	}
+
+	var cfg strings.Builder
+	for _, resolved := range p.Imports {
+		if resolved == "C" {
+			continue
+		}
+
+		dep, name, ok, err := g.packageFile(&job, resolved)
+		if err != nil {
+			return build.ID{}, fmt.Errorf("package %s: %w", p.ImportPath, err)
+		}
+		if !ok {
+			continue
+		}
+
+		importPath := resolved
+		if from, ok := sourceImport[resolved]; ok {
+			importPath = from
+		}
+		fmt.Fprintf(&cfg, "packagefile %s=%s/%s\n", build.EscapeTemplate(importPath), depRef(dep), name)
+	}
+
+	job.Cmds = append(job.Cmds, build.Cmd{
+		CatTemplate: cfg.String(),
+		CatOutput:   "{{.OutputDir}}/" + importcfg,
+	})
+
+	var files []string
+	for _, name := range p.GoFiles {
+		abs := name
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(p.Dir, name)
+		}
+
+		if rel, ok := g.RelPath(abs); ok {
+			if err := g.AddInput(&job, &inputs, rel); err != nil {
+				return build.ID{}, err
+			}
+			files = append(files, "{{.SourceDir}}/"+rel)
+			continue
+		}
+
+		// Generated files, like _testmain.go, live in the go build cache, and dependencies live in the module cache.
+		// Their content is embedded into the graph.
+		content, err := os.ReadFile(abs)
+		if err != nil {
+			return build.ID{}, err
+		}
+
+		generated := fmt.Sprintf("{{.OutputDir}}/src/%d.go", len(files))
+		job.Cmds = append(job.Cmds, build.Cmd{
+			CatTemplate: build.EscapeTemplate(string(content)),
+			CatOutput:   generated,
+		})
+		files = append(files, generated)
+	}
+
+	compilePath := pkgPath(p)
+	if p.Name == "main" {
+		compilePath = "main"
+	}
+
+	args := []string{
+		"go", "tool", "compile",
+		"-o", "{{.OutputDir}}/" + pkgArchive,
+		"-p", compilePath,
+		"-importcfg", "{{.OutputDir}}/" + importcfg,
+		"-trimpath", "{{.SourceDir}}",
+		"-pack",
+		"-complete",
+	}
+	if p.Module != nil && p.Module.GoVersion != "" {
+		args = append(args, "-lang=go"+p.Module.GoVersion)
+	}
+	args = append(args, files...)
+
+	job.Cmds = append(job.Cmds, build.Cmd{Exec: args})
+
+	id := g.AddJob(job, inputs)
+	g.compiled[p.ImportPath] = id
+	return id, nil
+}
+
+func (g *generator) link(p *Package, compileID build.ID) (build.ID, error) {
+	job := build.Job{Name: "link " + p.ImportPath}
+	buildgen.AddDep(&job, compileID)
+
+	// Test variants of packages must win over original packages with the same path.
+	files := map[string]string{}
+	variant := map[string]bool{}
+	for _, resolved := range p.Deps {
+		dep, name, ok, err := g.packageFile(&job, resolved)
+		if err != nil {
+			return build.ID{}, fmt.Errorf("package %s: %w", p.ImportPath, err)
+		}
+		if !ok {
+			continue
+		}
+
+		importPath, _, isVariant := strings.Cut(resolved, " ")
+		if variant[importPath] && !isVariant {
+			continue
+		}
+
+		files[importPath] = depRef(dep) + "/" + name
+		variant[importPath] = isVariant
+	}
+
+	importPaths := make([]string, 0, len(files))
+	for importPath := range files {
+		importPaths = append(importPaths, importPath)
+	}
+	sort.Strings(importPaths)
+
+	var cfg strings.Builder
+	for _, importPath := range importPaths {
+		fmt.Fprintf(&cfg, "packagefile %s=%s\n", build.EscapeTemplate(importPath), files[importPath])
+	}
+
+	job.Cmds = []build.Cmd{
+		{
+			CatTemplate: cfg.String(),
+			CatOutput:   "{{.OutputDir}}/" + importcfg,
+		},
+		{
+			Exec: []string{
+				"go", "tool", "link",
+				"-o", "{{.OutputDir}}/" + BinaryName(p),
+				"-importcfg", "{{.OutputDir}}/" + importcfg,
+				"-buildmode=exe",
+				depRef(compileID) + "/" + pkgArchive,
+			},
+		},
+	}
+
+	return g.AddJob(job, nil), nil
+}
+
+// BinaryName returns name of the executable produced by link job of the main package.
+func BinaryName(p *Package) string {
+	return path.Base(pkgPath(p))
+}
+
+type vetConfig struct {
+	ID                        string
+	Compiler                  string
+	Dir                       string
+	ImportPath                string
+	GoFiles                   []string
+	ImportMap                 map[string]string
+	PackageFile               map[string]string
+	VetxOutput                string
+	GoVersion                 string
+	SucceedOnTypecheckFailure bool
+}
+
+func (g *generator) vet(p *Package) error {
+	job := build.Job{Name: "vet " + p.ImportPath}
+	var inputs []build.ID
+
+	rel, ok := g.RelPath(p.Dir)
+	if !ok {
+		return nil
+	}
+
+	// Paths of the config are known only on the worker. They are marshaled as placeholders,
+	// which are replaced with templates rendering JSON strings.
+	var paths []string
+	workerPath := func(dirExpr, name string) string {
+		paths = append(paths, fmt.Sprintf(`{{printf "%%s/%%s" %s %q | json}}`, dirExpr, name))
+		return fmt.Sprintf("\x00%d", len(paths)-1)
+	}
+
+	cfg := vetConfig{
+		ID:          p.ImportPath,
+		Compiler:    "gc",
+		Dir:         workerPath(".SourceDir", rel),
+		ImportPath:  p.ImportPath,
+		ImportMap:   map[string]string{},
+		PackageFile: map[string]string{},
+		VetxOutput:  workerPath(".OutputDir", "vet.out"),
+	}
+	if p.Module != nil && p.Module.GoVersion != "" {
+		cfg.GoVersion = "go" + p.Module.GoVersion
+	}
+
+	for _, name := range p.GoFiles {
+		fileRel := path.Join(rel, name)
+		if err := g.AddInput(&job, &inputs, fileRel); err != nil {
+			return err
+		}
+		cfg.GoFiles = append(cfg.GoFiles, workerPath(".SourceDir", fileRel))
+	}
+
+	sourceImport := map[string]string{}
+	for from, to := range p.ImportMap {
+		sourceImport[to] = from
+	}
+
+	for _, resolved := range p.Imports {
+		dep, name, ok, err := g.packageFile(&job, resolved)
+		if err != nil {
+			return fmt.Errorf("package %s: %w", p.ImportPath, err)
+		}
+
+		importPath := resolved
+		if from, ok := sourceImport[resolved]; ok {
+			importPath = from
+		}
+		cfg.ImportMap[importPath] = resolved
+		if ok {
+			cfg.PackageFile[resolved] = workerPath(depExpr(dep), name)
+		}
+	}
+
+	text, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmpl := build.EscapeTemplate(string(text))
+	for i, ref := range paths {
+		tmpl = strings.Replace(tmpl, fmt.Sprintf(`"\u0000%d"`, i), ref, 1)
+	}
+
+	job.Cmds = []build.Cmd{
+		{
+			CatTemplate: tmpl,
+			CatOutput:   "{{.OutputDir}}/vet.cfg",
+		},
+		{
+			Exec: []string{"go", "tool", "vet", "{{.OutputDir}}/vet.cfg"},
+		},
+	}
+
+	g.AddJob(job, inputs)
+	return nil
+}
+
+func (g *generator) test(p *Package, linkID build.ID) error {
+	job := build.Job{Name: "test " + strings.TrimSuffix(p.ImportPath, ".test")}
+	buildgen.AddDep(&job, linkID)
+
+	var inputs []build.ID
+
+	rel, _ := g.RelPath(p.Dir)
+
+	testdata := filepath.Join(p.Dir, "testdata")
+	err := filepath.WalkDir(testdata, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		fileRel, ok := g.RelPath(file)
+		if !ok {
+			return nil
+		}
+		return g.AddInput(&job, &inputs, fileRel)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	exec := append([]string{depRef(linkID) + "/" + BinaryName(p)}, g.config.TestArgs...)
+	job.Cmds = []build.Cmd{
+		{
+			Exec:             exec,
+			WorkingDirectory: path.Join("{{.SourceDir}}", rel),
+		},
+	}
+
+	g.AddJob(job, inputs)
+	return nil
+}
@@ -0,0 +1,172 @@
+package gobuild_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build/buildtest"
+	"gitlab.com/slon/shad-go/distbuild/pkg/gobuild"
+)
+
+func jobNames(graph *build.Graph) []string {
+	var names []string
+	for _, job := range graph.Jobs {
+		names = append(names, job.Name)
+	}
+	return names
+}
+
+func TestGenerate(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+
+	sourceDir, err := filepath.Abs("testdata/hello")
+	require.NoError(t, err)
+
+	pkgs, err := gobuild.List(context.Background(), sourceDir, "./...")
+	require.NoError(t, err)
+
+	graph, err := gobuild.Generate(pkgs, gobuild.Config{
+		SourceRoot: sourceDir,
+		Vet:        true,
+		Test:       true,
+		TestArgs:   []string{"-test.v"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, graph.Validate())
+
+	names := jobNames(graph)
+	require.Contains(t, names, "compile example.com/hello/lib")
+	require.Contains(t, names, "link example.com/hello")
+	require.Contains(t, names, "vet example.com/hello/lib")
+	require.Contains(t, names, "test example.com/hello/lib")
+
+	stdout := buildtest.Run(t, graph, sourceDir).Stdout
+	require.Contains(t, stdout["test example.com/hello/lib"], "--- PASS: TestGreeting")
+	require.Contains(t, stdout["test example.com/hello/lib"], "--- PASS: ExampleGreeting")
+
+	for _, job := range graph.Jobs {
+		if job.Name == "compile example.com/hello/lib" {
+			require.Equal(t, []string{"lib/lib.go"}, job.Inputs)
+		}
+
+		if job.Name == "test example.com/hello/lib" {
+			require.Equal(t, []string{"lib/testdata/want.txt"}, job.Inputs)
+		}
+	}
+}
+
+func TestGenerateStable(t *testing.T) {
+	pkgs, err := gobuild.ParseList(strings.NewReader(`
+{"Dir": "/src/a", "ImportPath": "example.com/a", "Name": "a", "GoFiles": ["a.go"], "Imports": ["example.com/b", "fmt", "unsafe"]}
+{"Dir": "/mod/b", "ImportPath": "example.com/b", "Name": "b", "GoFiles": ["b.go"]}
+{"Dir": "/goroot/src/fmt", "ImportPath": "fmt", "Name": "fmt", "Standard": true}
+{"Dir": "/goroot/src/unsafe", "ImportPath": "unsafe", "Name": "unsafe", "Standard": true}
+`))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 4)
+
+	// Package b lives outside of the source root, like packages from the module cache.
+	root := filepath.Join(t.TempDir(), "root")
+	external := t.TempDir()
+	for _, p := range pkgs[:2] {
+		dir := root
+		if p.Name == "b" {
+			dir = external
+		}
+		p.Dir = filepath.Join(dir, filepath.Base(p.Dir))
+		require.NoError(t, os.MkdirAll(p.Dir, 0777))
+		require.NoError(t, os.WriteFile(filepath.Join(p.Dir, p.GoFiles[0]), []byte("package "+p.Name), 0666))
+	}
+
+	first, err := gobuild.Generate(pkgs, gobuild.Config{SourceRoot: root, Vet: true})
+	require.NoError(t, err)
+	require.NoError(t, first.Validate())
+
+	second, err := gobuild.Generate(pkgs, gobuild.Config{SourceRoot: root, Vet: true})
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+
+	require.Equal(t, []string{"stdlib", "compile example.com/b", "compile example.com/a", "vet example.com/a"}, jobNames(first))
+	stdlib, b, a, vet := first.Jobs[0], first.Jobs[1], first.Jobs[2], first.Jobs[3]
+
+	require.Equal(t, "fmt", stdlib.Cmds[0].Exec[len(stdlib.Cmds[0].Exec)-1])
+
+	require.Empty(t, b.Inputs)
+	require.Equal(t, "package b", b.Cmds[1].CatTemplate)
+
+	require.Equal(t, []string{"a/a.go"}, a.Inputs)
+	require.ElementsMatch(t, []build.ID{stdlib.ID, b.ID}, a.Deps)
+
+	// Paths of the vet config are escaped when the config is rendered on the worker.
+	rendered, err := vet.Cmds[0].Render(build.JobContext{
+		SourceDir: `/src/"{{dir}}"`,
+		OutputDir: `/out\vet`,
+		Deps: map[build.ID]string{
+			stdlib.ID: "/jobs/stdlib",
+			b.ID:      "/jobs/b",
+		},
+	})
+	require.NoError(t, err)
+
+	var cfg struct {
+		Dir         string
+		GoFiles     []string
+		PackageFile map[string]string
+		VetxOutput  string
+	}
+	require.NoError(t, json.Unmarshal([]byte(rendered.CatTemplate), &cfg))
+	require.Equal(t, `/src/"{{dir}}"/a`, cfg.Dir)
+	require.Equal(t, []string{`/src/"{{dir}}"/a/a.go`}, cfg.GoFiles)
+	require.Equal(t, map[string]string{"example.com/b": "/jobs/b/_pkg_.a", "fmt": "/jobs/stdlib/fmt.a"}, cfg.PackageFile)
+	require.Equal(t, `/out\vet/vet.out`, cfg.VetxOutput)
+}
+
+func TestGenerateUnsupported(t *testing.T) {
+	for _, tc := range []struct {
+		name, pkg, err string
+	}{
+		{
+			name: "cgo",
+			pkg:  `{"ImportPath": "example.com/a", "Name": "a", "CgoFiles": ["a.go"]}`,
+			err:  "cgo, assembly and embed are not supported",
+		},
+		{
+			name: "embed",
+			pkg:  `{"ImportPath": "example.com/a", "Name": "a", "GoFiles": ["a.go"], "EmbedPatterns": ["*.txt"], "EmbedFiles": ["a.txt"]}`,
+			err:  "cgo, assembly and embed are not supported",
+		},
+		{
+			name: "test embed",
+			pkg:  `{"ImportPath": "example.com/a", "Name": "a", "GoFiles": ["a.go"], "TestEmbedPatterns": ["testdata"]}`,
+			err:  "cgo, assembly and embed are not supported",
+		},
+		{
+			name: "error",
+			pkg:  `{"ImportPath": "example.com/a", "Name": "a", "Incomplete": true, "Error": {"Err": "no Go files"}}`,
+			err:  "no Go files",
+		},
+		{
+			name: "incomplete",
+			pkg:  `{"ImportPath": "example.com/a", "Name": "a", "GoFiles": ["a.go"], "Incomplete": true}`,
+			err:  "incomplete",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkgs, err := gobuild.ParseList(strings.NewReader(tc.pkg))
+			require.NoError(t, err)
+
+			_, err = gobuild.Generate(pkgs, gobuild.Config{SourceRoot: t.TempDir()})
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package gobuild
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Package описывает один пакет из вывода `go list -json`.
+//
+// Перечислены только те поля, которые использует генератор графа.
+type Package struct {
+	Dir        string
+	ImportPath string
+	Name       string
+	ForTest    string
+	Standard   bool
+
+	GoFiles      []string
+	CgoFiles     []string
+	SFiles       []string
+	TestGoFiles  []string
+	XTestGoFiles []string
+
+	EmbedPatterns      []string
+	EmbedFiles         []string
+	TestEmbedPatterns  []string
+	XTestEmbedPatterns []string
+
+	Imports   []string
+	ImportMap map[string]string
+	Deps      []string
+
+	Module *Module
+
+	Incomplete bool
+	Error      *PackageError
+}
+
+type Module struct {
+	Path      string
+	Main      bool
+	GoVersion string
+}
+
+type PackageError struct {
+	Err string
+}
+
+// ParseList reads stream of json objects produced by `go list -json`.
+func ParseList(r io.Reader) ([]*Package, error) {
+	var pkgs []*Package
+
+	dec := json.NewDecoder(r)
+	for {
+		var p Package
+		if err := dec.Decode(&p); errors.Is(err, io.EOF) {
+			return pkgs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error parsing go list output: %w", err)
+		}
+
+		pkgs = append(pkgs, &p)
+	}
+}
+
+// ParseListFile reads output of `go list -json` saved to a file.
+func ParseListFile(path string) ([]*Package, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseList(f)
+}
+
+// List runs `go list -deps -test -json` inside dir.
+func List(ctx context.Context, dir string, patterns ...string) ([]*Package, error) {
+	args := append([]string{"list", "-deps", "-test", "-json"}, patterns...)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go list failed: %w: %s", err, stderr.Bytes())
+	}
+
+	return ParseList(&stdout)
+}
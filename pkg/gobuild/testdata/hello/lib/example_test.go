@@ -0,0 +1,12 @@
+package lib_test
+
+import (
+	"fmt"
+
+	"example.com/hello/lib"
+)
+
+func ExampleGreeting() {
+	fmt.Println(lib.Greeting("world"))
+	// Output: Hello, WORLD
+}
@@ -0,0 +1,7 @@
+package lib
+
+import "strings"
+
+func Greeting(name string) string {
+	return "Hello, " + strings.ToUpper(name)
+}
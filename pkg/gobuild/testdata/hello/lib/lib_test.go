@@ -0,0 +1,18 @@
+package lib
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGreeting(t *testing.T) {
+	want, err := os.ReadFile("testdata/want.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := Greeting("gopher"); got != strings.TrimSpace(string(want)) {
+		t.Fatalf("got %q", got)
+	}
+}
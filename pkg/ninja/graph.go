@@ -0,0 +1,345 @@
+package ninja
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build/buildgen"
+)
+
+// Config задаёт параметры конвертации build.ninja.
+type Config struct {
+	// SourceRoot задаёт директорию, которую клиент использует как директорию с исходным кодом.
+	//
+	// Пути в build.ninja считаются относительными к SourceRoot, и команды запускаются из неё.
+	SourceRoot string
+}
+
+type edge struct {
+	build *Build
+	rule  *Rule
+
+	vars Scope
+
+	outputs         []string
+	implicitOutputs []string
+	inputs          []string
+	implicitInputs  []string
+	orderOnly       []string
+}
+
+// input is a resolved path used by an edge. Either job is set or path is a source file.
+type input struct {
+	path string
+	job  *build.ID
+}
+
+type generator struct {
+	*buildgen.Builder
+
+	config Config
+
+	edges    []*edge
+	producer map[string]*edge
+
+	jobs     map[*edge]build.ID
+	visiting map[*edge]bool
+}
+
+// Generate converts parsed build.ninja into a build graph with one job per build statement.
+//
+// Paths substituted through $in and $out are rewritten to {{.SourceDir}}, {{.OutputDir}} and
+// output directories of deps. Phony edges are resolved into their inputs. Generator edges, that
+// regenerate build.ninja itself, are skipped.
+func Generate(f *File, config Config) (*build.Graph, error) {
+	root, err := filepath.Abs(config.SourceRoot)
+	if err != nil {
+		return nil, err
+	}
+	config.SourceRoot = root
+
+	g := &generator{
+		Builder:  buildgen.NewBuilder(root),
+		config:   config,
+		producer: map[string]*edge{},
+		jobs:     map[*edge]build.ID{},
+		visiting: map[*edge]bool{},
+	}
+
+	for _, b := range f.Builds {
+		e := newEdge(b, f.Rules[b.Rule])
+		g.edges = append(g.edges, e)
+
+		for _, out := range append(append([]string{}, e.outputs...), e.implicitOutputs...) {
+			if _, ok := g.producer[out]; ok {
+				return nil, fmt.Errorf("multiple rules generate %s", out)
+			}
+			g.producer[out] = e
+		}
+	}
+
+	for _, e := range g.edges {
+		if e.rule.Name == "phony" || e.generator() {
+			continue
+		}
+
+		if _, err := g.job(e); err != nil {
+			return nil, err
+		}
+	}
+
+	return g.Graph, nil
+}
+
+func cleanPaths(l []EvalString, scope Scope) []string {
+	var paths []string
+	for _, p := range l {
+		paths = append(paths, path.Clean(p.Eval(scope)))
+	}
+	return paths
+}
+
+func newEdge(b *Build, rule *Rule) *edge {
+	e := &edge{build: b, rule: rule}
+
+	bindings := map[string]string{}
+	for k, v := range b.Bindings {
+		bindings[k] = v.Eval(b.scope)
+	}
+
+	e.vars = func(name string) (string, bool) {
+		if v, ok := bindings[name]; ok {
+			return v, true
+		}
+		return b.scope(name)
+	}
+
+	e.outputs = cleanPaths(b.Outputs, e.vars)
+	e.implicitOutputs = cleanPaths(b.ImplicitOutputs, e.vars)
+	e.inputs = cleanPaths(b.Inputs, e.vars)
+	e.implicitInputs = cleanPaths(b.ImplicitInputs, e.vars)
+	e.orderOnly = cleanPaths(b.OrderOnly, e.vars)
+	return e
+}
+
+func (e *edge) generator() bool {
+	v, ok := e.rule.Bindings["generator"]
+	return ok && v.Eval(e.vars) != ""
+}
+
+// scope returns scope used for evaluation of rule bindings, as described in ninja manual.
+func (e *edge) scope(special map[string]string) Scope {
+	var lookup Scope
+	depth := 0
+
+	lookup = func(name string) (string, bool) {
+		if v, ok := special[name]; ok {
+			return v, true
+		}
+		if v, ok := e.build.Bindings[name]; ok {
+			return v.Eval(e.build.scope), true
+		}
+		if v, ok := e.rule.Bindings[name]; ok {
+			// Protect from infinite recursion in self referencing rule variables.
+			if depth > 64 {
+				return "", false
+			}
+			depth++
+			defer func() { depth-- }()
+			return v.Eval(lookup), true
+		}
+		return e.build.scope(name)
+	}
+	return lookup
+}
+
+// resolve maps path to the edges producing it, following phony edges.
+func (g *generator) resolve(p string, seen map[string]bool) ([]input, error) {
+	if seen[p] {
+		return nil, nil
+	}
+	seen[p] = true
+
+	e, ok := g.producer[p]
+	if !ok {
+		if _, err := os.Stat(filepath.Join(g.config.SourceRoot, filepath.FromSlash(p))); err != nil {
+			return nil, fmt.Errorf("%s is missing and no known rule to make it", p)
+		}
+		return []input{{path: p}}, nil
+	}
+
+	if e.rule.Name != "phony" {
+		id, err := g.job(e)
+		if err != nil {
+			return nil, err
+		}
+		return []input{{path: p, job: &id}}, nil
+	}
+
+	// Phony edge without inputs is an alias for a file, that may be absent.
+	all := append(append(append([]string{}, e.inputs...), e.implicitInputs...), e.orderOnly...)
+	if len(all) == 0 {
+		if _, err := os.Stat(filepath.Join(g.config.SourceRoot, filepath.FromSlash(p))); err == nil {
+			return []input{{path: p}}, nil
+		}
+		return nil, nil
+	}
+
+	var result []input
+	for _, in := range all {
+		resolved, err := g.resolve(in, seen)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, resolved...)
+	}
+	return result, nil
+}
+
+// pathRef описывает путь, который известен только на воркере: файл внутри директории,
+// заданной выражением шаблона.
+type pathRef struct {
+	dir  string
+	path string
+}
+
+func depDir(id build.ID) string {
+	return fmt.Sprintf("index .Deps %q", id.String())
+}
+
+// template returns template rendering the path, shell-quoted if quote is set.
+func (r pathRef) template(quote bool) string {
+	if !quote {
+		return "{{" + r.dir + "}}/" + build.EscapeTemplate(r.path)
+	}
+	return fmt.Sprintf(`{{printf "%%s/%%s" (%s) %q | quote}}`, r.dir, r.path)
+}
+
+// pathRefs substitutes paths into values of ninja variables.
+//
+// Variables are evaluated with placeholders instead of paths. Afterwards the rest of the value
+// is escaped for text/template and placeholders are replaced with templates of the paths.
+type pathRefs []pathRef
+
+func (refs *pathRefs) add(dir, path string) string {
+	*refs = append(*refs, pathRef{dir: dir, path: path})
+	return fmt.Sprintf("\x00%d\x00", len(*refs)-1)
+}
+
+func (refs pathRefs) render(value string, quote bool) string {
+	value = build.EscapeTemplate(value)
+	for i, ref := range refs {
+		value = strings.ReplaceAll(value, fmt.Sprintf("\x00%d\x00", i), ref.template(quote))
+	}
+	return value
+}
+
+func (g *generator) job(e *edge) (build.ID, error) {
+	if id, ok := g.jobs[e]; ok {
+		return id, nil
+	}
+	if g.visiting[e] {
+		return build.ID{}, fmt.Errorf("dependency cycle involving %s", e.outputs[0])
+	}
+	g.visiting[e] = true
+	defer delete(g.visiting, e)
+
+	job := build.Job{}
+	var inputIDs []build.ID
+	addedInputs := map[string]bool{}
+	var refs pathRefs
+
+	use := func(paths []string) ([]string, error) {
+		var rewritten []string
+		for _, p := range paths {
+			resolved, err := g.resolve(p, map[string]bool{})
+			if err != nil {
+				return nil, fmt.Errorf("build %s: %w", e.outputs[0], err)
+			}
+
+			for _, in := range resolved {
+				if in.job != nil {
+					buildgen.AddDep(&job, *in.job)
+					rewritten = append(rewritten, refs.add(depDir(*in.job), in.path))
+					continue
+				}
+
+				if !addedInputs[in.path] {
+					addedInputs[in.path] = true
+					if err := g.AddInput(&job, &inputIDs, in.path); err != nil {
+						return nil, err
+					}
+				}
+				rewritten = append(rewritten, refs.add(".SourceDir", in.path))
+			}
+		}
+		return rewritten, nil
+	}
+
+	in, err := use(e.inputs)
+	if err != nil {
+		return build.ID{}, err
+	}
+	if _, err := use(append(append([]string{}, e.implicitInputs...), e.orderOnly...)); err != nil {
+		return build.ID{}, err
+	}
+
+	var out []string
+	dirs := map[string]bool{}
+	var mkdirs []string
+	for _, p := range append(append([]string{}, e.outputs...), e.implicitOutputs...) {
+		if dir := path.Dir(p); dir != "." && !dirs[dir] {
+			dirs[dir] = true
+			mkdirs = append(mkdirs, "{{.OutputDir}}/"+build.EscapeTemplate(dir))
+		}
+	}
+	for _, p := range e.outputs {
+		out = append(out, refs.add(".OutputDir", p))
+	}
+
+	scope := e.scope(map[string]string{
+		"in":         strings.Join(in, " "),
+		"in_newline": strings.Join(in, "\n"),
+		"out":        strings.Join(out, " "),
+	})
+
+	if len(mkdirs) != 0 {
+		job.Cmds = append(job.Cmds, build.Cmd{Exec: append([]string{"mkdir", "-p"}, mkdirs...)})
+	}
+
+	// Like ninja, paths are shell-quoted in command and rspfile_content, but not in the name of rspfile.
+	if rspfile, ok := scope("rspfile"); ok && rspfile != "" {
+		relative := !strings.HasPrefix(rspfile, "\x00")
+		rspfile = refs.render(rspfile, false)
+		if relative {
+			rspfile = "{{.OutputDir}}/" + rspfile
+		}
+		content, _ := scope("rspfile_content")
+		job.Cmds = append(job.Cmds, build.Cmd{CatTemplate: refs.render(content, true), CatOutput: rspfile})
+	}
+
+	command, _ := scope("command")
+	job.Cmds = append(job.Cmds, build.Cmd{
+		Exec:             []string{"sh", "-c", refs.render(command, true)},
+		WorkingDirectory: "{{.SourceDir}}",
+	})
+
+	// Description is evaluated with original paths to get a readable job name.
+	plain := e.scope(map[string]string{
+		"in":  strings.Join(e.inputs, " "),
+		"out": strings.Join(e.outputs, " "),
+	})
+
+	job.Name = e.rule.Name + " " + e.outputs[0]
+	if description, _ := plain("description"); description != "" {
+		job.Name = description
+	}
+
+	id := g.AddJob(job, inputIDs)
+	g.jobs[e] = id
+	return id, nil
+}
@@ -0,0 +1,166 @@
+package ninja_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build/buildtest"
+	"gitlab.com/slon/shad-go/distbuild/pkg/ninja"
+)
+
+func TestParse(t *testing.T) {
+	f, err := ninja.Parse(strings.NewReader(`
+# comment
+flags = -O2
+flags = $flags -g
+
+rule cc
+  command = cc $flags $
+      -c $in -o $out
+
+build out$ dir/a$:b.o | a.d: cc a$ b.c | h.h || gen
+  flags = ${flags} -Wall
+`), ".")
+	require.NoError(t, err)
+
+	require.Equal(t, "-O2 -g", f.Vars["flags"])
+	require.Contains(t, f.Rules, "cc")
+	require.Contains(t, f.Rules, "phony")
+	require.Len(t, f.Builds, 1)
+
+	b := f.Builds[0]
+	require.Equal(t, "cc", b.Rule)
+
+	eval := func(l []ninja.EvalString) []string {
+		var result []string
+		for _, s := range l {
+			result = append(result, s.Eval(func(string) (string, bool) { return "", false }))
+		}
+		return result
+	}
+
+	require.Equal(t, []string{"out dir/a:b.o"}, eval(b.Outputs))
+	require.Equal(t, []string{"a.d"}, eval(b.ImplicitOutputs))
+	require.Equal(t, []string{"a b.c"}, eval(b.Inputs))
+	require.Equal(t, []string{"h.h"}, eval(b.ImplicitInputs))
+	require.Equal(t, []string{"gen"}, eval(b.OrderOnly))
+
+	command := f.Rules["cc"].Bindings["command"].Eval(func(name string) (string, bool) {
+		return map[string]string{"flags": "-O0", "in": "x.c", "out": "x.o"}[name], true
+	})
+	require.Equal(t, "cc -O0 -c x.c -o x.o", command)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, content := range []string{
+		"build a: missing b\n",
+		"rule cc\n  description = no command\n",
+		"build: phony\n",
+		"  indented = 1\n",
+	} {
+		_, err := ninja.Parse(strings.NewReader(content), ".")
+		require.Error(t, err, content)
+	}
+}
+
+func findJob(t *testing.T, graph *build.Graph, name string) build.Job {
+	for _, job := range graph.Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+
+	t.Fatalf("job %q not found", name)
+	return build.Job{}
+}
+
+func TestGenerate(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc is not installed")
+	}
+
+	root, err := filepath.Abs("testdata/project")
+	require.NoError(t, err)
+
+	f, err := ninja.ParseFile(filepath.Join(root, "build.ninja"))
+	require.NoError(t, err)
+
+	graph, err := ninja.Generate(f, ninja.Config{SourceRoot: root})
+	require.NoError(t, err)
+	require.NoError(t, graph.Validate())
+	require.Len(t, graph.Jobs, 5, "generator and phony edges must be skipped")
+
+	gen := findJob(t, graph, "gen gen/version.c")
+
+	main := findJob(t, graph, "CC obj/main.o")
+	require.Equal(t, []string{"src/main.c", "include/greet.h"}, main.Inputs)
+	require.Equal(t, []build.ID{gen.ID}, main.Deps, "order-only deps must be respected")
+	require.Equal(t, []string{"mkdir", "-p", "{{.OutputDir}}/obj"}, main.Cmds[0].Exec)
+	require.Equal(t, []string{
+		"sh", "-c",
+		`gcc -Wall -Iinclude -DGREETING_SUFFIX=\"!\" -c {{printf "%s/%s" (.SourceDir) "src/main.c" | quote}} -o {{printf "%s/%s" (.OutputDir) "obj/main.o" | quote}}`,
+	}, main.Cmds[1].Exec)
+
+	version := findJob(t, graph, "CC obj/version.o")
+	require.Empty(t, version.Inputs)
+	require.Equal(t, []build.ID{gen.ID}, version.Deps)
+
+	link := findJob(t, graph, "LINK hello")
+	require.Len(t, link.Deps, 3)
+	require.Equal(t, "{{.OutputDir}}/hello.rsp", link.Cmds[0].CatOutput)
+
+	result := buildtest.Run(t, graph, root)
+
+	out, err := exec.Command(filepath.Join(result.OutputDir["LINK hello"], "hello")).CombinedOutput()
+	require.NoError(t, err)
+	require.Equal(t, "Hello, ninja! 1.0\n", string(out))
+}
+
+func TestGenerateMissingInput(t *testing.T) {
+	f, err := ninja.Parse(strings.NewReader(`
+rule cc
+  command = cc -c $in -o $out
+
+build a.o: cc missing.c
+`), ".")
+	require.NoError(t, err)
+
+	_, err = ninja.Generate(f, ninja.Config{SourceRoot: t.TempDir()})
+	require.ErrorContains(t, err, "missing.c is missing and no known rule to make it")
+}
+
+func TestGenerateEscaping(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a b.txt"), []byte("A"), 0666))
+
+	f, err := ninja.Parse(strings.NewReader(`
+rule concat
+  command = cat $in > $out && echo '{{not a template}}' >> $out
+  rspfile = $out.rsp
+  rspfile_content = $in_newline {{.OutputDir}}
+
+build out$ dir/all.txt: concat a$ b.txt
+`), root)
+	require.NoError(t, err)
+
+	graph, err := ninja.Generate(f, ninja.Config{SourceRoot: root})
+	require.NoError(t, err)
+	require.NoError(t, graph.Validate())
+
+	result := buildtest.Run(t, graph, root)
+	outputDir := result.OutputDir["concat out dir/all.txt"]
+
+	content, err := os.ReadFile(filepath.Join(outputDir, "out dir", "all.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "A{{not a template}}\n", string(content))
+
+	rsp, err := os.ReadFile(filepath.Join(outputDir, "out dir", "all.txt.rsp"))
+	require.NoError(t, err)
+	require.Equal(t, "'"+filepath.Join(root, "a b.txt")+"' {{.OutputDir}}", string(rsp))
+}
@@ -0,0 +1,405 @@
+package ninja
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EvalString is a string with unexpanded variable references.
+type EvalString []evalToken
+
+type evalToken struct {
+	text  string
+	isVar bool
+}
+
+// Scope resolves variable references.
+type Scope func(name string) (string, bool)
+
+// Eval expands variable references. Unknown variables expand to empty string, as in ninja.
+func (s EvalString) Eval(scope Scope) string {
+	var b strings.Builder
+	for _, tok := range s {
+		if !tok.isVar {
+			b.WriteString(tok.text)
+			continue
+		}
+
+		if value, ok := scope(tok.text); ok {
+			b.WriteString(value)
+		}
+	}
+	return b.String()
+}
+
+// Rule описывает правило из build.ninja.
+type Rule struct {
+	Name     string
+	Bindings map[string]EvalString
+}
+
+// Build описывает одно ребро графа сборки из build.ninja.
+type Build struct {
+	Rule string
+
+	Outputs         []EvalString
+	ImplicitOutputs []EvalString
+
+	Inputs         []EvalString
+	ImplicitInputs []EvalString
+	OrderOnly      []EvalString
+
+	Bindings map[string]EvalString
+
+	// scope is the file scope at the moment of declaration.
+	scope Scope
+}
+
+// File описывает разобранный build.ninja.
+type File struct {
+	Vars   map[string]string
+	Rules  map[string]*Rule
+	Builds []*Build
+}
+
+// ParseFile parses build.ninja. Files referenced by include and subninja are resolved relative to
+// the directory of path.
+func ParseFile(path string) (*File, error) {
+	f := &File{
+		Vars:  map[string]string{},
+		Rules: map[string]*Rule{"phony": {Name: "phony", Bindings: map[string]EvalString{}}},
+	}
+
+	p := &parser{file: f, dir: filepath.Dir(path)}
+	if err := p.parseFile(path); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Parse parses build.ninja from r. include and subninja statements are resolved relative to dir.
+func Parse(r io.Reader, dir string) (*File, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{
+		Vars:  map[string]string{},
+		Rules: map[string]*Rule{"phony": {Name: "phony", Bindings: map[string]EvalString{}}},
+	}
+
+	p := &parser{file: f, dir: dir}
+	if err := p.parse("build.ninja", string(content)); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type parser struct {
+	file *File
+	dir  string
+}
+
+func (p *parser) fileScope() Scope {
+	vars := make(map[string]string, len(p.file.Vars))
+	for k, v := range p.file.Vars {
+		vars[k] = v
+	}
+
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func (p *parser) parseFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return p.parse(path, string(content))
+}
+
+// joinLines removes escaped newlines together with indentation of the next line.
+func joinLines(content string) string {
+	var b strings.Builder
+	for i := 0; i < len(content); i++ {
+		if content[i] != '$' || i+1 == len(content) {
+			b.WriteByte(content[i])
+			continue
+		}
+
+		switch content[i+1] {
+		case '\n':
+			i += 2
+			for i < len(content) && content[i] == ' ' {
+				i++
+			}
+			i--
+		case '\r':
+			if i+2 < len(content) && content[i+2] == '\n' {
+				i += 3
+				for i < len(content) && content[i] == ' ' {
+					i++
+				}
+				i--
+				continue
+			}
+			b.WriteString(content[i : i+2])
+			i++
+		default:
+			b.WriteString(content[i : i+2])
+			i++
+		}
+	}
+	return b.String()
+}
+
+func (p *parser) parse(name, content string) error {
+	lines := strings.Split(joinLines(content), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		lineno := i + 1
+
+		errorf := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", name, lineno, fmt.Sprintf(format, args...))
+		}
+
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed != line {
+			return errorf("unexpected indent")
+		}
+
+		// Collect indented bindings following the statement.
+		bindings := map[string]EvalString{}
+		for i+1 < len(lines) {
+			next := strings.TrimRight(lines[i+1], "\r")
+			nextTrimmed := strings.TrimLeft(next, " ")
+			if nextTrimmed == next || nextTrimmed == "" {
+				break
+			}
+			i++
+
+			if strings.HasPrefix(nextTrimmed, "#") {
+				continue
+			}
+
+			key, value, err := parseBinding(nextTrimmed)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", name, i+1, err)
+			}
+			bindings[key] = value
+		}
+
+		keyword, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimLeft(rest, " ")
+
+		switch keyword {
+		case "rule":
+			ruleName := strings.TrimSpace(rest)
+			if _, ok := p.file.Rules[ruleName]; ok {
+				return errorf("duplicate rule %q", ruleName)
+			}
+			if _, ok := bindings["command"]; !ok {
+				return errorf("rule %q has no command", ruleName)
+			}
+			p.file.Rules[ruleName] = &Rule{Name: ruleName, Bindings: bindings}
+
+		case "build":
+			b, err := parseBuild(rest)
+			if err != nil {
+				return errorf("%v", err)
+			}
+			if _, ok := p.file.Rules[b.Rule]; !ok {
+				return errorf("unknown rule %q", b.Rule)
+			}
+			b.Bindings = bindings
+			b.scope = p.fileScope()
+			p.file.Builds = append(p.file.Builds, b)
+
+		case "pool", "default":
+			// Pools and default targets do not affect the build graph.
+
+		case "include", "subninja":
+			// subninja has its own variable scope in ninja. Here it is treated as include.
+			path := parseEval(strings.TrimSpace(rest)).Eval(p.fileScope())
+			if err := p.parseFile(filepath.Join(p.dir, path)); err != nil {
+				return err
+			}
+
+		default:
+			key, value, err := parseBinding(line)
+			if err != nil {
+				return errorf("%v", err)
+			}
+			p.file.Vars[key] = value.Eval(p.fileScope())
+		}
+	}
+
+	return nil
+}
+
+func parseBinding(line string) (string, EvalString, error) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return "", nil, fmt.Errorf("expected '=' in %q", line)
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", nil, fmt.Errorf("empty variable name in %q", line)
+	}
+
+	return key, parseEval(strings.TrimLeft(value, " ")), nil
+}
+
+// parseEval parses value of a variable. Spaces and colons are literal.
+func parseEval(s string) EvalString {
+	var (
+		result EvalString
+		lit    strings.Builder
+	)
+
+	flush := func() {
+		if lit.Len() != 0 {
+			result = append(result, evalToken{text: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			lit.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch c := s[i]; {
+		case c == '$' || c == ' ' || c == ':':
+			lit.WriteByte(c)
+		case c == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end == -1 {
+				lit.WriteString(s[i-1:])
+				i = len(s)
+				continue
+			}
+			flush()
+			result = append(result, evalToken{text: s[i+1 : i+end], isVar: true})
+			i += end
+		case isVarChar(c):
+			j := i
+			for j < len(s) && isVarChar(s[j]) {
+				j++
+			}
+			flush()
+			result = append(result, evalToken{text: s[i:j], isVar: true})
+			i = j - 1
+		default:
+			lit.WriteByte('$')
+			lit.WriteByte(c)
+		}
+	}
+
+	flush()
+	return result
+}
+
+func isVarChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// splitPaths splits build line into words. Escaped spaces and colons are part of the word,
+// unescaped ':', '|' and '||' are returned as separate words.
+func splitPaths(s string) []string {
+	var (
+		words []string
+		cur   strings.Builder
+	)
+
+	flush := func() {
+		if cur.Len() != 0 {
+			words = append(words, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '$' && i+1 < len(s):
+			cur.WriteByte(c)
+			cur.WriteByte(s[i+1])
+			i++
+		case c == ' ':
+			flush()
+		case c == ':':
+			flush()
+			words = append(words, ":")
+		case c == '|':
+			flush()
+			if i+1 < len(s) && s[i+1] == '|' {
+				words = append(words, "||")
+				i++
+			} else {
+				words = append(words, "|")
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+
+	flush()
+	return words
+}
+
+func parseBuild(line string) (*Build, error) {
+	b := &Build{}
+
+	words := splitPaths(line)
+
+	i := 0
+	target := &b.Outputs
+	for ; i < len(words) && words[i] != ":"; i++ {
+		if words[i] == "|" {
+			target = &b.ImplicitOutputs
+			continue
+		}
+		*target = append(*target, parseEval(words[i]))
+	}
+
+	if i == len(words) {
+		return nil, fmt.Errorf("expected ':' in build statement")
+	}
+	if len(b.Outputs) == 0 {
+		return nil, fmt.Errorf("build statement has no outputs")
+	}
+	i++
+
+	if i == len(words) {
+		return nil, fmt.Errorf("build statement has no rule")
+	}
+	b.Rule = words[i]
+	i++
+
+	target = &b.Inputs
+	for ; i < len(words); i++ {
+		switch words[i] {
+		case "|":
+			target = &b.ImplicitInputs
+		case "||":
+			target = &b.OrderOnly
+		default:
+			*target = append(*target, parseEval(words[i]))
+		}
+	}
+
+	return b, nil
+}
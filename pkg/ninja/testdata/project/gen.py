@@ -0,0 +1 @@
+# regenerates build.ninja
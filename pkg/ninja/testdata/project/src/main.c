@@ -0,0 +1,10 @@
+#include <stdio.h>
+
+#include "greet.h"
+
+const char* version(void);
+
+int main(void) {
+    printf("%s%s %s\n", greeting(), GREETING_SUFFIX, version());
+    return 0;
+}
@@ -0,0 +1,304 @@
+//go:build !solution
+
+package scheduler
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// Owner описывает сборку, которой принадлежит джоб.
+type Owner struct {
+	Build build.ID
+	User  string
+	Class string
+}
+
+// BuildShare описывает, какую долю воркеров получает сборка.
+type BuildShare struct {
+	Build  build.ID
+	User   string
+	Class  string
+	Weight float64
+
+	// Queued задаёт число джобов сборки, ждущих в очереди.
+	Queued int
+
+	// Picked задаёт число джобов сборки, выданных воркерам.
+	Picked int
+
+	// Share задаёт долю Picked среди джобов, выданных всем сборкам из очереди.
+	Share float64
+}
+
+// buildQueue хранит джобы одной сборки, отсортированные по приоритету.
+type buildQueue struct {
+	owner  Owner
+	weight float64
+	seq    int
+	jobs   []*PendingJob
+
+	// served задаёт виртуальное время сборки: сколько джобов ей выдано с учётом веса.
+	served float64
+	picked int
+}
+
+// BlockingQueue выдаёт джобы, честно разделяя воркеры между сборками.
+//
+// Каждая сборка получает долю выданных джобов, пропорциональную своему весу. Сборка, в которой
+// долго не было готовых джобов, не получает преимущества за время простоя.
+type BlockingQueue struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	weight func(Owner) float64
+	builds map[build.ID]*buildQueue
+	seq    int
+
+	// virtual задаёт виртуальное время сборки, чей джоб был выдан последним.
+	virtual float64
+	closed  bool
+}
+
+// NewQueue creates queue, that computes weight of each build with weight.
+//
+// If weight is nil, all builds get equal share.
+func NewQueue(weight func(Owner) float64) *BlockingQueue {
+	var queue BlockingQueue
+	queue.cond = sync.NewCond(&queue.mutex)
+	queue.weight = weight
+	queue.builds = make(map[build.ID]*buildQueue)
+	return &queue
+}
+
+// Put adds job to the queue of its build. Jobs with higher priority are taken first,
+// jobs with equal priority are taken in FIFO order.
+func (q *BlockingQueue) Put(job *PendingJob) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.put(job)
+}
+
+// Handover puts job, dropped from the queue of a finished build, into the queue of owner's build.
+func (q *BlockingQueue) Handover(job *PendingJob, owner Owner) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job.Owner = owner
+	q.put(job)
+}
+
+func (q *BlockingQueue) put(job *PendingJob) {
+	if q.closed {
+		return
+	}
+
+	b, ok := q.builds[job.Owner.Build]
+	if !ok {
+		b = &buildQueue{owner: job.Owner, weight: 1, seq: q.seq}
+		if q.weight != nil {
+			b.weight = q.weight(job.Owner)
+		}
+		q.seq++
+		q.builds[job.Owner.Build] = b
+	}
+
+	if len(b.jobs) == 0 && b.served < q.virtual {
+		b.served = q.virtual
+	}
+
+	b.insert(job)
+	q.cond.Broadcast()
+}
+
+// Raise increases priority of the job if it is still waiting in the queue.
+func (q *BlockingQueue) Raise(job *PendingJob, priority Priority) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !job.Priority.Less(priority) {
+		return
+	}
+
+	b, ok := q.builds[job.Owner.Build]
+	if !ok {
+		return
+	}
+
+	for i := range b.jobs {
+		if b.jobs[i] == job {
+			b.jobs = append(b.jobs[:i], b.jobs[i+1:]...)
+			job.Priority = priority
+			b.insert(job)
+			q.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// Remove drops the job from the queue if it is still waiting there.
+func (q *BlockingQueue) Remove(job *PendingJob) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	b, ok := q.builds[job.Owner.Build]
+	if !ok {
+		return
+	}
+
+	for i := range b.jobs {
+		if b.jobs[i] == job {
+			b.jobs = append(b.jobs[:i], b.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *buildQueue) insert(job *PendingJob) {
+	i := sort.Search(len(b.jobs), func(i int) bool {
+		return b.jobs[i].Priority.Less(job.Priority)
+	})
+
+	b.jobs = append(b.jobs, nil)
+	copy(b.jobs[i+1:], b.jobs[i:])
+	b.jobs[i] = job
+}
+
+// placement описывает решение о том, можно ли отдать джоб воркеру.
+type placement int
+
+const (
+	// placeSkip означает, что джоб не подходит воркеру, и нужно смотреть следующие джобы в очереди.
+	placeSkip placement = iota
+
+	// placeTake означает, что джоб нужно отдать воркеру.
+	placeTake
+
+	// placeWait означает, что воркер зарезервирован под этот джоб и не должен брать джобы после него.
+	placeWait
+)
+
+// Take removes the first job accepted by match from the queue.
+//
+// Builds are visited in order of their priority, and among builds of equal priority the one
+// that received the smallest weighted share goes first. Take blocks until matching job appears,
+// queue is closed or ctx is done.
+func (q *BlockingQueue) Take(ctx context.Context, match func(*PendingJob) placement) (*PendingJob, bool) {
+	stop := context.AfterFunc(ctx, func() {
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		q.cond.Broadcast()
+	})
+	defer stop()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && ctx.Err() == nil {
+		if job := q.take(match); job != nil {
+			return job, true
+		}
+
+		q.cond.Wait()
+	}
+
+	return nil, false
+}
+
+func (q *BlockingQueue) take(match func(*PendingJob) placement) *PendingJob {
+	var active []*buildQueue
+	for _, b := range q.builds {
+		if len(b.jobs) != 0 {
+			active = append(active, b)
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		a, b := active[i], active[j]
+		if a.jobs[0].Priority.Build != b.jobs[0].Priority.Build {
+			return a.jobs[0].Priority.Build > b.jobs[0].Priority.Build
+		}
+		if a.served != b.served {
+			return a.served < b.served
+		}
+		return a.seq < b.seq
+	})
+
+	for _, b := range active {
+		for i, job := range b.jobs {
+			switch match(job) {
+			case placeTake:
+				b.jobs = append(b.jobs[:i], b.jobs[i+1:]...)
+
+				b.served += 1 / b.weight
+				q.virtual = b.served
+				b.picked++
+				return job
+
+			case placeWait:
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// FinishBuild forgets about the build and drops its jobs from the queue.
+//
+// Dropped jobs are returned, so that the caller can hand them over to other builds waiting for them.
+func (q *BlockingQueue) FinishBuild(id build.ID) []*PendingJob {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	b, ok := q.builds[id]
+	if !ok {
+		return nil
+	}
+
+	delete(q.builds, id)
+	return b.jobs
+}
+
+// Shares returns share of every build known to the queue, in order of build arrival.
+func (q *BlockingQueue) Shares() []BuildShare {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	total := 0
+	shares := make([]BuildShare, 0, len(q.builds))
+	for _, b := range q.builds {
+		total += b.picked
+		shares = append(shares, BuildShare{
+			Build:  b.owner.Build,
+			User:   b.owner.User,
+			Class:  b.owner.Class,
+			Weight: b.weight,
+			Queued: len(b.jobs),
+			Picked: b.picked,
+		})
+	}
+
+	sort.Slice(shares, func(i, j int) bool {
+		return q.builds[shares[i].Build].seq < q.builds[shares[j].Build].seq
+	})
+
+	if total != 0 {
+		for i := range shares {
+			shares[i].Share = float64(shares[i].Picked) / float64(total)
+		}
+	}
+
+	return shares
+}
+
+func (q *BlockingQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
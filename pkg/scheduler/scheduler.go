@@ -4,6 +4,8 @@ package scheduler
 
 import (
 	"context"
+	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -15,90 +17,116 @@ import (
 
 var TimeAfter = time.After
 
-type BlockingQueue struct {
-	mutex  sync.Mutex
-	cond   *sync.Cond
-	queue  []*PendingJob
-	closed bool
+// Priority задаёт порядок, в котором джобы выдаются воркерам.
+//
+// Сначала сравнивается приоритет сборки, затем длина критического пути от джоба до конца сборки.
+type Priority struct {
+	Build        int
+	CriticalPath time.Duration
 }
 
-func NewQueue() *BlockingQueue {
-	var queue BlockingQueue
-	queue.cond = sync.NewCond(&queue.mutex)
-	queue.queue = make([]*PendingJob, 0)
-	queue.closed = false
-	return &queue
-}
-
-func (q *BlockingQueue) Put(job *PendingJob) {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
-
-	if q.closed {
-		return
-	}
-
-	q.queue = append(q.queue, job)
-	if len(q.queue) > 0 {
-		q.cond.Broadcast()
+func (p Priority) Less(other Priority) bool {
+	if p.Build != other.Build {
+		return p.Build < other.Build
 	}
+	return p.CriticalPath < other.CriticalPath
 }
 
-func (q *BlockingQueue) Take() (*PendingJob, bool) {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+type PendingJob struct {
+	Job      *api.JobSpec
+	Owner    Owner
+	Priority Priority
+	Finished chan struct{}
+	Result   *api.JobResult
 
-	for len(q.queue) == 0 && !q.closed {
-		q.cond.Wait()
-	}
+	// Picked закрывается, когда джоб выдан воркеру.
+	Picked chan struct{}
 
-	if len(q.queue) == 0 {
-		return nil, false
-	}
+	// Worker задаёт воркер, которому выдан джоб.
+	Worker api.WorkerID
 
-	job := q.queue[0]
-	q.queue = q.queue[1:]
-	return job, true
-}
+	// CompletedBy задаёт воркер, чей результат записан в Result. Заполняется до закрытия Finished.
+	//
+	// Для джоба со спекулятивной копией это воркер той попытки, чей результат засчитан.
+	CompletedBy api.WorkerID
 
-func (q *BlockingQueue) Close() {
-	q.mutex.Lock()
-	defer q.mutex.Unlock()
+	// SpeculativeOf задаёт исходную попытку, если этот PendingJob является её спекулятивной копией.
+	//
+	// Копия разделяет с исходной попыткой Finished и Result. Засчитывается первый успешный результат,
+	// а ошибка - только когда другая попытка уже не работает.
+	SpeculativeOf *PendingJob
 
-	q.closed = true
-	q.cond.Broadcast()
-}
+	// FailedOn перечисляет воркеры, на которых предыдущие попытки джоба завершились сбоем инфраструктуры.
+	// Пока есть другие воркеры, джоб им не выдаётся.
+	FailedOn []api.WorkerID
 
-type PendingJob struct {
-	Job      *api.JobSpec
-	Finished chan struct{}
-	Result   *api.JobResult
+	// failure хранит ошибку попытки, которая ещё не засчитана, потому что другая попытка джоба
+	// продолжает работать.
+	failure *api.JobResult
+
+	// owners перечисляет незавершённые сборки, которые ждут джоб. Когда завершается сборка Owner,
+	// джоб из очереди передаётся следующей из них.
+	owners []Owner
 }
 
 type Config struct {
 	CacheTimeout time.Duration
 	DepsTimeout  time.Duration
+
+	// UserWeights и ClassWeights задают веса пользователей и классов сборок.
+	//
+	// Вес сборки равен произведению веса её пользователя и веса её класса. Сборка с весом 2 получает
+	// вдвое больше воркеров, чем одновременная с ней сборка с весом 1. Отсутствующие в таблицах
+	// пользователи и классы получают вес 1.
+	UserWeights  map[string]float64
+	ClassWeights map[string]float64
+}
+
+func (c *Config) weight(owner Owner) float64 {
+	weight := 1.0
+	if w, ok := c.UserWeights[owner.User]; ok && w > 0 {
+		weight *= w
+	}
+	if w, ok := c.ClassWeights[owner.Class]; ok && w > 0 {
+		weight *= w
+	}
+	return weight
 }
 
 type Scheduler struct {
-	queue     *BlockingQueue
-	logger    *zap.Logger
-	config    Config
-	Artifacts map[build.ID]api.WorkerID
+	queue  *BlockingQueue
+	logger *zap.Logger
+	config Config
+
+	// Artifacts хранит для каждого артефакта воркеры, на которых он есть, в порядке предпочтения.
+	Artifacts map[build.ID][]api.WorkerID
 
 	resJobs map[build.ID]*PendingJob
-	mutex   sync.Mutex
+	workers map[api.WorkerID]WorkerInfo
+
+	// speculative хранит спекулятивные копии джобов, которые ещё не завершились.
+	speculative map[build.ID]*PendingJob
 
-	helping sync.WaitGroup
+	// cancel хранит для каждого воркера джобы, которые он должен отменить.
+	cancel map[api.WorkerID][]build.ID
+
+	// buildJobs хранит для каждой незавершённой сборки джобы, которые она ждёт.
+	buildJobs map[build.ID][]*PendingJob
+
+	mutex sync.Mutex
 }
 
 func NewScheduler(l *zap.Logger, config Config) *Scheduler {
 	var sched Scheduler
-	sched.queue = NewQueue()
 	sched.logger = l
 	sched.config = config
-	sched.Artifacts = make(map[build.ID]api.WorkerID)
+	sched.queue = NewQueue(sched.config.weight)
+	sched.Artifacts = make(map[build.ID][]api.WorkerID)
 	sched.resJobs = make(map[build.ID]*PendingJob)
+	sched.workers = make(map[api.WorkerID]WorkerInfo)
+	sched.speculative = make(map[build.ID]*PendingJob)
+	sched.cancel = make(map[api.WorkerID][]build.ID)
+	sched.buildJobs = make(map[build.ID][]*PendingJob)
 
 	return &sched
 }
@@ -106,37 +134,128 @@ func NewScheduler(l *zap.Logger, config Config) *Scheduler {
 func (c *Scheduler) LocateArtifact(id build.ID) (api.WorkerID, bool) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	worker, ok := c.Artifacts[id]
-	return worker, ok
+	holders := c.Artifacts[id]
+	if len(holders) == 0 {
+		return "", false
+	}
+	return holders[0], true
+}
+
+// ArtifactHolders returns all workers known to have the artifact, preferred first.
+func (c *Scheduler) ArtifactHolders(id build.ID) []api.WorkerID {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Clone(c.Artifacts[id])
+}
+
+// AddArtifact records that the artifact appeared on the worker, e.g. after the worker downloaded it.
+func (c *Scheduler) AddArtifact(id build.ID, workerID api.WorkerID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !slices.Contains(c.Artifacts[id], workerID) {
+		c.Artifacts[id] = append(c.Artifacts[id], workerID)
+	}
+}
+
+// RemoveArtifact forgets that the worker has the artifact, e.g. after download from it failed.
+//
+// Download may fail because of a transient error, so the last known holder is never forgotten.
+// Otherwise the artifact would be lost for good: its producer is already finished and is not rebuilt.
+func (c *Scheduler) RemoveArtifact(id build.ID, workerID api.WorkerID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	holders := c.Artifacts[id]
+	if len(holders) == 1 && holders[0] == workerID {
+		return
+	}
+	c.removeArtifact(id, workerID)
+}
+
+func (c *Scheduler) removeArtifact(id build.ID, workerID api.WorkerID) {
+	holders := slices.DeleteFunc(c.Artifacts[id], func(w api.WorkerID) bool { return w == workerID })
+	if len(holders) == 0 {
+		delete(c.Artifacts, id)
+	} else {
+		c.Artifacts[id] = holders
+	}
 }
 
 func (c *Scheduler) OnJobComplete(workerID api.WorkerID, jobID build.ID, res *api.JobResult) bool {
 	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pending, ok := c.resJobs[jobID]
+	if !ok {
+		return false
+	}
 
-	isChanClosed := true
 	select {
-	case _, isChanClosed = <-c.resJobs[jobID].Finished:
+	case <-pending.Finished:
+		return true
 	default:
 	}
 
-	if isChanClosed {
-		close(c.resJobs[jobID].Finished)
+	if duplicate, ok := c.speculative[jobID]; ok && (res.Error != nil || res.ExitCode != 0) {
+		attempts := []*PendingJob{duplicate.SpeculativeOf, duplicate}
+
+		running := false
+		for _, attempt := range attempts {
+			if attempt.Worker == workerID {
+				failure := *res
+				attempt.failure = &failure
+			} else if attempt.Worker != "" && attempt.failure == nil {
+				running = true
+			}
+		}
+
+		// Первый успешный результат засчитывается, поэтому ошибка ждёт, пока не завершится
+		// другая попытка. Если упали обе, неповторяемая ошибка важнее повторяемой.
+		if running {
+			return true
+		}
+		for _, attempt := range attempts {
+			if attempt.failure != nil && !attempt.failure.Retryable {
+				res, workerID = attempt.failure, attempt.Worker
+			}
+		}
 	}
 
-	c.resJobs[jobID].Result.ID = res.ID
-	c.resJobs[jobID].Result.ExitCode = res.ExitCode
-	c.resJobs[jobID].Result.Stdout = res.Stdout
-	c.resJobs[jobID].Result.Stderr = res.Stderr
-	c.resJobs[jobID].Result.Error = res.Error
-	c.mutex.Unlock()
+	// Result должен быть записан до закрытия Finished: ожидающие читают его без блокировки.
+	*pending.Result = *res
+	pending.CompletedBy = workerID
+	close(pending.Finished)
 
+	if res.Error == nil && res.ExitCode == 0 {
+		// Воркер, который собрал артефакт, становится основным источником.
+		c.removeArtifact(jobID, workerID)
+		c.Artifacts[jobID] = append([]api.WorkerID{workerID}, c.Artifacts[jobID]...)
+	}
+
+	if duplicate, ok := c.speculative[jobID]; ok {
+		delete(c.speculative, jobID)
+		c.queue.Remove(duplicate)
+
+		for _, attempt := range []*PendingJob{duplicate.SpeculativeOf, duplicate} {
+			if attempt.Worker != "" && attempt.Worker != workerID && attempt.failure == nil {
+				c.cancel[attempt.Worker] = append(c.cancel[attempt.Worker], jobID)
+			}
+		}
+	}
 	return true
 }
 
-func (c *Scheduler) ScheduleJob(job *api.JobSpec) *PendingJob {
+// ScheduleJob puts job into the queue of owner's build with the given priority.
+//
+// If the job is already scheduled, existing PendingJob is returned. Its priority is raised
+// if the new one is higher, but it stays in the queue of the build that scheduled it first,
+// until that build finishes.
+func (c *Scheduler) ScheduleJob(job *api.JobSpec, owner Owner, priority Priority) *PendingJob {
 	c.mutex.Lock()
 	if done, ok := c.resJobs[job.ID]; ok {
+		c.addOwner(done, owner)
 		c.mutex.Unlock()
+		c.queue.Raise(done, priority)
 		return done
 	} else {
 		c.mutex.Unlock()
@@ -144,43 +263,284 @@ func (c *Scheduler) ScheduleJob(job *api.JobSpec) *PendingJob {
 
 	pending := &PendingJob{}
 	pending.Job = job
+	pending.Owner = owner
+	pending.Priority = priority
 	pending.Finished = make(chan struct{})
 	pending.Result = &api.JobResult{}
+	pending.Picked = make(chan struct{})
 	c.queue.Put(pending)
 
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	c.resJobs[job.ID] = pending
+	c.addOwner(pending, owner)
 
 	return pending
 }
 
-func (c *Scheduler) PickJob(ctx context.Context, workerID api.WorkerID) *PendingJob {
-	waitJob := make(chan *PendingJob)
+func (c *Scheduler) addOwner(pending *PendingJob, owner Owner) {
+	if slices.Contains(pending.owners, owner) {
+		return
+	}
+	pending.owners = append(pending.owners, owner)
+	c.buildJobs[owner.Build] = append(c.buildJobs[owner.Build], pending)
+}
+
+// RetryJob puts job back into the queue after infrastructure failure of the previous attempt.
+//
+// New attempt avoids workers where previous attempts failed, unless no other worker is registered.
+// If the failed attempt was already retried, the existing new attempt is returned.
+func (c *Scheduler) RetryJob(failed *PendingJob) *PendingJob {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Джоб может быть общим для нескольких сборок, и каждая из них просит перезапуск.
+	// Новую попытку создаёт только первая, остальные получают её же.
+	if current, ok := c.resJobs[failed.Job.ID]; ok && current != failed {
+		return current
+	}
+
+	pending := &PendingJob{}
+	pending.Job = failed.Job
+	pending.Owner = failed.Owner
+	if len(failed.owners) != 0 {
+		pending.Owner = failed.owners[0]
+	}
+	pending.Priority = failed.Priority
+	pending.Finished = make(chan struct{})
+	pending.Result = &api.JobResult{}
+	pending.Picked = make(chan struct{})
+	pending.FailedOn = append(append([]api.WorkerID{}, failed.FailedOn...), failed.Worker)
+	for _, owner := range failed.owners {
+		c.addOwner(pending, owner)
+	}
+
+	c.resJobs[failed.Job.ID] = pending
+	delete(c.Artifacts, failed.Job.ID)
+
+	c.queue.Put(pending)
+	return pending
+}
+
+// SpeculateJob starts a copy of the running job on another worker.
+//
+// The first attempt that succeeds provides the result, and the worker running the other one
+// is asked to cancel it. Failure of one attempt is reported only after the other one fails too. pending must already be picked by a worker.
+// SpeculateJob returns nil if the job has already finished.
+func (c *Scheduler) SpeculateJob(pending *PendingJob) *PendingJob {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	c.helping.Add(1)
-	go func() {
-		defer c.helping.Done()
-		job, _ := c.queue.Take()
+	select {
+	case <-pending.Finished:
+		return nil
+	default:
+	}
+
+	if duplicate, ok := c.speculative[pending.Job.ID]; ok {
+		return duplicate
+	}
+
+	duplicate := &PendingJob{}
+	duplicate.Job = pending.Job
+	duplicate.Owner = pending.Owner
+	if len(pending.owners) != 0 {
+		duplicate.Owner = pending.owners[0]
+	}
+	duplicate.Priority = pending.Priority
+	duplicate.Finished = pending.Finished
+	duplicate.Result = pending.Result
+	duplicate.Picked = make(chan struct{})
+	duplicate.FailedOn = pending.FailedOn
+	duplicate.SpeculativeOf = pending
+
+	c.speculative[pending.Job.ID] = duplicate
+	c.queue.Put(duplicate)
+	return duplicate
+}
+
+// TakeCancellations returns jobs that the worker must cancel and forgets about them.
+func (c *Scheduler) TakeCancellations(workerID api.WorkerID) []build.ID {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	jobs := c.cancel[workerID]
+	delete(c.cancel, workerID)
+	return jobs
+}
+
+// WorkerInfo описывает воркер, который запрашивает джоб.
+type WorkerInfo struct {
+	ID api.WorkerID
+
+	// Total задаёт все ресурсы воркера. Нулевое поле означает, что воркер не сообщил этот ресурс,
+	// и по нему джобы не ограничиваются.
+	Total build.Resources
+
+	// Free задаёт ресурсы, не занятые джобами, которые уже выполняются на воркере.
+	Free build.Resources
+
+	// Labels задаёт метки воркера, с которыми сравниваются build.Job.Constraints.
+	Labels map[string]string
+}
 
-		select {
-		case waitJob <- job:
-		case <-ctx.Done():
+// RegisterWorker remembers the worker, so CheckPlacement takes it into account.
+func (c *Scheduler) RegisterWorker(worker WorkerInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.workers[worker.ID] = worker
+}
+
+// CheckPlacement returns error if none of registered workers can ever run the job.
+//
+// While no worker is registered, any job is considered placeable.
+func (c *Scheduler) CheckPlacement(job *build.Job) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.workers) == 0 {
+		return nil
+	}
+
+	for _, worker := range c.workers {
+		worker.Free = worker.Total
+		if place(job, &worker) != placeSkip {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("job %s (%s) can't run on any of %d registered workers: constraints %q, resources %+v",
+		job.ID, job.Name, len(c.workers), job.Constraints, job.Resources)
+}
+
+// PickJob returns the oldest job that fits into free resources of the worker.
+//
+// A job that does not fit into free resources now, but fits into total resources of the worker,
+// reserves this worker: jobs queued after it are not given to the worker. Otherwise a stream of
+// small jobs could starve the big one forever.
+func (c *Scheduler) PickJob(ctx context.Context, worker WorkerInfo) *PendingJob {
+	c.mutex.Lock()
+	workers := make([]api.WorkerID, 0, len(c.workers))
+	for id := range c.workers {
+		workers = append(workers, id)
+	}
+	c.mutex.Unlock()
+
+	job, ok := c.queue.Take(ctx, func(job *PendingJob) placement {
+		if job.SpeculativeOf != nil && job.SpeculativeOf.Worker == worker.ID {
+			return placeSkip
+		}
+		if avoidWorker(job, worker.ID, workers) {
+			return placeSkip
 		}
-	}()
+		return place(&job.Job.Job, &worker)
+	})
+	if !ok {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
+	// Спекулятивная копия могла стать ненужной, пока её забирали из очереди.
 	select {
-	case job := <-waitJob:
-		c.mutex.Lock()
-		c.Artifacts[job.Job.ID] = workerID
-		c.mutex.Unlock()
-		return job
-	case <-ctx.Done():
+	case <-job.Finished:
 		return nil
+	default:
+	}
+
+	job.Worker = worker.ID
+	close(job.Picked)
+	return job
+}
+
+// avoidWorker checks whether job failed on worker before and some other worker hasn't failed it yet.
+func avoidWorker(job *PendingJob, worker api.WorkerID, workers []api.WorkerID) bool {
+	if !slices.Contains(job.FailedOn, worker) {
+		return false
 	}
+
+	for _, other := range workers {
+		if !slices.Contains(job.FailedOn, other) {
+			return true
+		}
+	}
+	return false
+}
+
+func place(job *build.Job, worker *WorkerInfo) placement {
+	for _, constraint := range job.Constraints {
+		if !constraint.Match(worker.Labels) {
+			return placeSkip
+		}
+	}
+
+	type dimension struct{ need, total, free int64 }
+
+	fitsTotal, fitsFree := true, true
+	for _, d := range []dimension{
+		{job.Resources.MilliCPU, worker.Total.MilliCPU, worker.Free.MilliCPU},
+		{job.Resources.Memory, worker.Total.Memory, worker.Free.Memory},
+		{job.Resources.Pids, worker.Total.Pids, worker.Free.Pids},
+	} {
+		if d.need == 0 || d.total == 0 {
+			continue
+		}
+		if d.need > d.total {
+			fitsTotal = false
+		}
+		if d.need > d.free {
+			fitsFree = false
+		}
+	}
+
+	switch {
+	case !fitsTotal:
+		return placeSkip
+	case !fitsFree:
+		return placeWait
+	default:
+		return placeTake
+	}
+}
+
+// FinishBuild releases state of the build kept for fair sharing and drops its queued jobs.
+//
+// Jobs that other builds still wait for are moved to the queue of one of them. Other dropped jobs
+// are forgotten, so that the next build scheduling them starts a new attempt.
+func (c *Scheduler) FinishBuild(id build.ID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, pending := range c.buildJobs[id] {
+		pending.owners = slices.DeleteFunc(pending.owners, func(o Owner) bool { return o.Build == id })
+	}
+	delete(c.buildJobs, id)
+
+	for _, pending := range c.queue.FinishBuild(id) {
+		if pending.SpeculativeOf != nil {
+			if c.speculative[pending.Job.ID] == pending {
+				delete(c.speculative, pending.Job.ID)
+			}
+			continue
+		}
+
+		if len(pending.owners) != 0 {
+			c.queue.Handover(pending, pending.owners[0])
+			continue
+		}
+
+		if c.resJobs[pending.Job.ID] == pending {
+			delete(c.resJobs, pending.Job.ID)
+		}
+	}
+}
+
+// Shares reports how workers are shared between builds.
+func (c *Scheduler) Shares() []BuildShare {
+	return c.queue.Shares()
 }
 
 func (c *Scheduler) Stop() {
 	c.queue.Close()
-	c.helping.Wait()
 }
@@ -0,0 +1,505 @@
+package scheduler_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+)
+
+const gb = 1 << 30
+
+func newJob(id byte, res build.Resources) *api.JobSpec {
+	return &api.JobSpec{Job: build.Job{ID: build.ID{id}, Resources: res}}
+}
+
+func newWorker(id string, total, free build.Resources) scheduler.WorkerInfo {
+	return scheduler.WorkerInfo{ID: api.WorkerID(id), Total: total, Free: free}
+}
+
+// pick returns ID of the job picked by the worker, or zero ID if nothing was picked in time.
+func pick(t *testing.T, s *scheduler.Scheduler, w scheduler.WorkerInfo) build.ID {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	job := s.PickJob(ctx, w)
+	if job == nil {
+		return build.ID{}
+	}
+	return job.Job.ID
+}
+
+func newScheduler(t *testing.T) *scheduler.Scheduler {
+	s := scheduler.NewScheduler(zaptest.NewLogger(t), scheduler.Config{})
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func TestPickJobFitsResources(t *testing.T) {
+	s := newScheduler(t)
+
+	s.ScheduleJob(newJob('b', build.Resources{Memory: 8 * gb}), scheduler.Owner{}, scheduler.Priority{})
+	s.ScheduleJob(newJob('s', build.Resources{Memory: 1 * gb}), scheduler.Owner{}, scheduler.Priority{})
+
+	small := build.Resources{MilliCPU: 2000, Memory: 4 * gb}
+	big := build.Resources{MilliCPU: 16000, Memory: 64 * gb}
+
+	require.Equal(t, build.ID{'s'}, pick(t, s, newWorker("small", small, small)))
+	require.Equal(t, build.ID{}, pick(t, s, newWorker("small", small, small)))
+	require.Equal(t, build.ID{'b'}, pick(t, s, newWorker("big", big, big)))
+}
+
+func TestPickJobReservesWorkerForBigJob(t *testing.T) {
+	s := newScheduler(t)
+
+	total := build.Resources{MilliCPU: 8000, Memory: 16 * gb}
+	busy := build.Resources{MilliCPU: 2000, Memory: 2 * gb}
+
+	s.ScheduleJob(newJob('b', build.Resources{MilliCPU: 8000}), scheduler.Owner{}, scheduler.Priority{})
+	for i := byte(0); i < 3; i++ {
+		s.ScheduleJob(newJob('0'+i, build.Resources{MilliCPU: 1000}), scheduler.Owner{}, scheduler.Priority{})
+	}
+
+	// The worker could run small jobs right now, but it is reserved for the big one.
+	require.Equal(t, build.ID{}, pick(t, s, newWorker("w", total, busy)))
+
+	require.Equal(t, build.ID{'b'}, pick(t, s, newWorker("w", total, total)))
+	require.Equal(t, build.ID{'0'}, pick(t, s, newWorker("w", total, busy)))
+}
+
+func TestPickJobUnknownResources(t *testing.T) {
+	s := newScheduler(t)
+
+	s.ScheduleJob(newJob('a', build.Resources{MilliCPU: 64000, Memory: 64 * gb, Pids: 100}), scheduler.Owner{}, scheduler.Priority{})
+
+	require.Equal(t, build.ID{'a'}, pick(t, s, newWorker("legacy", build.Resources{}, build.Resources{})))
+}
+
+func TestPickJobWaitsForFittingJob(t *testing.T) {
+	s := newScheduler(t)
+
+	w := newWorker("w", build.Resources{Memory: gb}, build.Resources{Memory: gb})
+
+	picked := make(chan *scheduler.PendingJob)
+	go func() {
+		picked <- s.PickJob(context.Background(), w)
+	}()
+
+	s.ScheduleJob(newJob('b', build.Resources{Memory: 2 * gb}), scheduler.Owner{}, scheduler.Priority{})
+	s.ScheduleJob(newJob('s', build.Resources{Memory: gb / 2}), scheduler.Owner{}, scheduler.Priority{})
+
+	select {
+	case job := <-picked:
+		require.Equal(t, build.ID{'s'}, job.Job.ID)
+	case <-time.After(time.Second):
+		t.Fatal("PickJob did not return")
+	}
+}
+
+func TestPickJobCanceled(t *testing.T) {
+	s := newScheduler(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Nil(t, s.PickJob(ctx, scheduler.WorkerInfo{ID: "w"}))
+
+	// Job must not be lost by canceled PickJob.
+	s.ScheduleJob(newJob('a', build.Resources{}), scheduler.Owner{}, scheduler.Priority{})
+	require.Equal(t, build.ID{'a'}, pick(t, s, scheduler.WorkerInfo{ID: "w"}))
+}
+
+func TestPickJobConstraints(t *testing.T) {
+	s := newScheduler(t)
+
+	job := newJob('a', build.Resources{})
+	job.Constraints = []build.Constraint{"gcc=12", "!arm"}
+	s.ScheduleJob(job, scheduler.Owner{}, scheduler.Priority{})
+
+	gcc11 := scheduler.WorkerInfo{ID: "gcc11", Labels: map[string]string{"gcc": "11"}}
+	gcc12arm := scheduler.WorkerInfo{ID: "gcc12arm", Labels: map[string]string{"gcc": "12", "arm": ""}}
+	gcc12 := scheduler.WorkerInfo{ID: "gcc12", Labels: map[string]string{"gcc": "12"}}
+
+	require.Equal(t, build.ID{}, pick(t, s, gcc11))
+	require.Equal(t, build.ID{}, pick(t, s, gcc12arm))
+	require.Equal(t, build.ID{'a'}, pick(t, s, gcc12))
+}
+
+func TestCheckPlacement(t *testing.T) {
+	s := newScheduler(t)
+
+	job := build.Job{
+		ID:          build.ID{'a'},
+		Constraints: []build.Constraint{"bigmem"},
+		Resources:   build.Resources{Memory: 32 * gb},
+	}
+
+	require.NoError(t, s.CheckPlacement(&job), "no workers are registered yet")
+
+	s.RegisterWorker(scheduler.WorkerInfo{
+		ID:     "small",
+		Total:  build.Resources{Memory: 8 * gb},
+		Labels: map[string]string{"bigmem": ""},
+	})
+	s.RegisterWorker(scheduler.WorkerInfo{
+		ID:    "unlabeled",
+		Total: build.Resources{Memory: 64 * gb},
+	})
+	require.Error(t, s.CheckPlacement(&job))
+
+	// Busy worker can still run the job later.
+	s.RegisterWorker(scheduler.WorkerInfo{
+		ID:     "big",
+		Total:  build.Resources{Memory: 64 * gb},
+		Free:   build.Resources{Memory: gb},
+		Labels: map[string]string{"bigmem": ""},
+	})
+	require.NoError(t, s.CheckPlacement(&job))
+}
+
+func TestPickJobPriority(t *testing.T) {
+	s := newScheduler(t)
+
+	s.ScheduleJob(newJob('a', build.Resources{}), scheduler.Owner{}, scheduler.Priority{CriticalPath: time.Second})
+	s.ScheduleJob(newJob('b', build.Resources{}), scheduler.Owner{}, scheduler.Priority{CriticalPath: time.Minute})
+	s.ScheduleJob(newJob('c', build.Resources{}), scheduler.Owner{}, scheduler.Priority{CriticalPath: time.Second})
+	s.ScheduleJob(newJob('d', build.Resources{}), scheduler.Owner{}, scheduler.Priority{Build: 1})
+	s.ScheduleJob(newJob('e', build.Resources{}), scheduler.Owner{}, scheduler.Priority{})
+
+	// Scheduling the same job again raises its priority.
+	s.ScheduleJob(newJob('e', build.Resources{}), scheduler.Owner{}, scheduler.Priority{CriticalPath: time.Hour})
+
+	w := scheduler.WorkerInfo{ID: "w"}
+	for _, id := range []byte("debac") {
+		require.Equal(t, build.ID{id}, pick(t, s, w))
+	}
+}
+
+func TestPickJobFairSharing(t *testing.T) {
+	s := newScheduler(t)
+
+	first := scheduler.Owner{Build: build.ID{'1'}, User: "alice"}
+	second := scheduler.Owner{Build: build.ID{'2'}, User: "bob"}
+
+	for _, id := range []byte("abcd") {
+		s.ScheduleJob(newJob(id, build.Resources{}), first, scheduler.Priority{})
+	}
+	for _, id := range []byte("xy") {
+		s.ScheduleJob(newJob(id, build.Resources{}), second, scheduler.Priority{})
+	}
+
+	w := scheduler.WorkerInfo{ID: "w"}
+	for _, id := range []byte("axbycd") {
+		require.Equal(t, build.ID{id}, pick(t, s, w))
+	}
+}
+
+func TestPickJobIdleBuildDoesNotBurst(t *testing.T) {
+	s := newScheduler(t)
+
+	first := scheduler.Owner{Build: build.ID{'1'}}
+	second := scheduler.Owner{Build: build.ID{'2'}}
+
+	w := scheduler.WorkerInfo{ID: "w"}
+	for _, id := range []byte("abc") {
+		s.ScheduleJob(newJob(id, build.Resources{}), first, scheduler.Priority{})
+		require.Equal(t, build.ID{id}, pick(t, s, w))
+	}
+
+	// The second build was idle while the first one was running, so it does not get
+	// the whole cluster to catch up.
+	for _, id := range []byte("def") {
+		s.ScheduleJob(newJob(id, build.Resources{}), first, scheduler.Priority{})
+	}
+	for _, id := range []byte("xyz") {
+		s.ScheduleJob(newJob(id, build.Resources{}), second, scheduler.Priority{})
+	}
+
+	for _, id := range []byte("dxeyfz") {
+		require.Equal(t, build.ID{id}, pick(t, s, w))
+	}
+}
+
+func TestPickJobWeights(t *testing.T) {
+	s := scheduler.NewScheduler(zaptest.NewLogger(t), scheduler.Config{
+		UserWeights:  map[string]float64{"alice": 2},
+		ClassWeights: map[string]float64{"ci": 0.5, "interactive": 2},
+	})
+	t.Cleanup(s.Stop)
+
+	heavy := scheduler.Owner{Build: build.ID{'1'}, User: "alice"}
+	light := scheduler.Owner{Build: build.ID{'2'}, User: "bob"}
+	ci := scheduler.Owner{Build: build.ID{'3'}, User: "alice", Class: "ci"}
+
+	for i := byte(0); i < 6; i++ {
+		s.ScheduleJob(newJob('a'+i, build.Resources{}), heavy, scheduler.Priority{})
+		s.ScheduleJob(newJob('A'+i, build.Resources{}), light, scheduler.Priority{})
+		s.ScheduleJob(newJob('0'+i, build.Resources{}), ci, scheduler.Priority{})
+	}
+
+	w := scheduler.WorkerInfo{ID: "w"}
+	for i := 0; i < 12; i++ {
+		require.NotEqual(t, build.ID{}, pick(t, s, w))
+	}
+
+	shares := s.Shares()
+	require.Len(t, shares, 3)
+
+	require.Equal(t, heavy.Build, shares[0].Build)
+	require.Equal(t, "alice", shares[0].User)
+	require.Equal(t, 2.0, shares[0].Weight)
+	require.Equal(t, 6, shares[0].Picked)
+	require.Equal(t, 0, shares[0].Queued)
+	require.InDelta(t, 0.5, shares[0].Share, 1e-9)
+
+	require.Equal(t, 1.0, shares[1].Weight)
+	require.Equal(t, 3, shares[1].Picked)
+	require.Equal(t, 3, shares[1].Queued)
+
+	require.Equal(t, 1.0, shares[2].Weight)
+	require.Equal(t, 3, shares[2].Picked)
+
+	s.FinishBuild(heavy.Build)
+	require.Len(t, s.Shares(), 2)
+}
+
+func TestPickJobBuildPriorityBeatsFairness(t *testing.T) {
+	s := newScheduler(t)
+
+	ci := scheduler.Owner{Build: build.ID{'1'}}
+	interactive := scheduler.Owner{Build: build.ID{'2'}}
+
+	s.ScheduleJob(newJob('a', build.Resources{}), ci, scheduler.Priority{})
+	s.ScheduleJob(newJob('b', build.Resources{}), ci, scheduler.Priority{})
+	s.ScheduleJob(newJob('x', build.Resources{}), interactive, scheduler.Priority{Build: 1})
+	s.ScheduleJob(newJob('y', build.Resources{}), interactive, scheduler.Priority{Build: 1})
+
+	w := scheduler.WorkerInfo{ID: "w"}
+	for _, id := range []byte("xyab") {
+		require.Equal(t, build.ID{id}, pick(t, s, w))
+	}
+}
+
+func TestFinishBuildDropsQueuedJobs(t *testing.T) {
+	s := newScheduler(t)
+
+	canceled := scheduler.Owner{Build: build.ID{'1'}}
+	other := scheduler.Owner{Build: build.ID{'2'}}
+
+	s.ScheduleJob(newJob('a', build.Resources{}), canceled, scheduler.Priority{})
+	s.ScheduleJob(newJob('b', build.Resources{}), canceled, scheduler.Priority{})
+	s.ScheduleJob(newJob('x', build.Resources{}), other, scheduler.Priority{})
+
+	s.FinishBuild(canceled.Build)
+
+	w := scheduler.WorkerInfo{ID: "w"}
+	require.Equal(t, build.ID{'x'}, pick(t, s, w))
+	require.Equal(t, build.ID{}, pick(t, s, w))
+
+	shares := s.Shares()
+	require.Len(t, shares, 1)
+	require.Equal(t, other.Build, shares[0].Build)
+
+	// The dropped job is forgotten, so the next build scheduling it gets a new attempt.
+	pending := s.ScheduleJob(newJob('a', build.Resources{}), other, scheduler.Priority{})
+	require.Equal(t, other, pending.Owner)
+	require.Equal(t, build.ID{'a'}, pick(t, s, w))
+}
+
+func TestFinishBuildHandsOverSharedJobs(t *testing.T) {
+	s := newScheduler(t)
+
+	canceled := scheduler.Owner{Build: build.ID{'1'}}
+	other := scheduler.Owner{Build: build.ID{'2'}}
+
+	first := s.ScheduleJob(newJob('a', build.Resources{}), canceled, scheduler.Priority{})
+	second := s.ScheduleJob(newJob('a', build.Resources{}), other, scheduler.Priority{})
+	require.Same(t, first, second)
+
+	s.FinishBuild(canceled.Build)
+
+	w := scheduler.WorkerInfo{ID: "w"}
+	require.Equal(t, build.ID{'a'}, pick(t, s, w))
+
+	shares := s.Shares()
+	require.Len(t, shares, 1)
+	require.Equal(t, other.Build, shares[0].Build)
+	require.Equal(t, 1, shares[0].Picked)
+}
+
+func TestRetryJobAvoidsFailedWorker(t *testing.T) {
+	s := newScheduler(t)
+
+	first := scheduler.WorkerInfo{ID: "first"}
+	second := scheduler.WorkerInfo{ID: "second"}
+	s.RegisterWorker(first)
+	s.RegisterWorker(second)
+
+	pending := s.ScheduleJob(newJob('a', build.Resources{}), scheduler.Owner{}, scheduler.Priority{})
+	require.Equal(t, build.ID{'a'}, pick(t, s, first))
+
+	errorText := "download failed"
+	s.OnJobComplete("first", build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}, Error: &errorText, Retryable: true})
+	<-pending.Finished
+
+	retry := s.RetryJob(pending)
+	require.Equal(t, []api.WorkerID{"first"}, retry.FailedOn)
+
+	// Another build sharing the job gets the same new attempt.
+	require.Same(t, retry, s.RetryJob(pending))
+
+	require.Equal(t, build.ID{}, pick(t, s, first))
+	require.Equal(t, build.ID{'a'}, pick(t, s, second))
+
+	s.OnJobComplete("second", build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}, Error: &errorText, Retryable: true})
+	<-retry.Finished
+
+	// Job failed everywhere, so any worker may try again.
+	retry = s.RetryJob(retry)
+	require.Equal(t, build.ID{'a'}, pick(t, s, first))
+
+	s.OnJobComplete("first", build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}})
+	<-retry.Finished
+	require.Nil(t, retry.Result.Error)
+}
+
+func TestSpeculateJob(t *testing.T) {
+	s := newScheduler(t)
+
+	first := scheduler.WorkerInfo{ID: "first"}
+	second := scheduler.WorkerInfo{ID: "second"}
+
+	pending := s.ScheduleJob(newJob('a', build.Resources{}), scheduler.Owner{}, scheduler.Priority{})
+	require.Equal(t, build.ID{'a'}, pick(t, s, first))
+	<-pending.Picked
+
+	duplicate := s.SpeculateJob(pending)
+	require.NotNil(t, duplicate)
+	require.Same(t, duplicate, s.SpeculateJob(pending))
+
+	// The copy never runs on the worker of the original attempt.
+	require.Equal(t, build.ID{}, pick(t, s, first))
+	require.Equal(t, build.ID{'a'}, pick(t, s, second))
+
+	s.OnJobComplete("second", build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}, Stdout: []byte("fast")})
+	<-pending.Finished
+	require.Equal(t, []byte("fast"), pending.Result.Stdout)
+	require.Equal(t, api.WorkerID("second"), pending.CompletedBy)
+
+	// Late result of the loser is ignored.
+	s.OnJobComplete("first", build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}, Stdout: []byte("slow")})
+	require.Equal(t, []byte("fast"), pending.Result.Stdout)
+	require.Equal(t, api.WorkerID("second"), pending.CompletedBy)
+
+	require.Equal(t, []build.ID{{'a'}}, s.TakeCancellations("first"))
+	require.Empty(t, s.TakeCancellations("first"))
+	require.Empty(t, s.TakeCancellations("second"))
+
+	worker, ok := s.LocateArtifact(build.ID{'a'})
+	require.True(t, ok)
+	require.Equal(t, api.WorkerID("second"), worker)
+
+	require.Nil(t, s.SpeculateJob(pending))
+}
+
+func TestSpeculativeCopyDroppedWhenOriginalFinishes(t *testing.T) {
+	s := newScheduler(t)
+
+	pending := s.ScheduleJob(newJob('a', build.Resources{}), scheduler.Owner{}, scheduler.Priority{})
+	require.Equal(t, build.ID{'a'}, pick(t, s, scheduler.WorkerInfo{ID: "first"}))
+	require.NotNil(t, s.SpeculateJob(pending))
+
+	s.OnJobComplete("first", build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}})
+
+	require.Equal(t, build.ID{}, pick(t, s, scheduler.WorkerInfo{ID: "second"}))
+	require.Empty(t, s.TakeCancellations("first"))
+	require.Empty(t, s.TakeCancellations("second"))
+}
+
+func TestSpeculativeFailureWaitsForOtherAttempt(t *testing.T) {
+	errorText := "download failed"
+
+	for _, tc := range []struct {
+		name   string
+		second *api.JobResult
+		want   *api.JobResult
+	}{
+		{
+			name:   "success wins",
+			second: &api.JobResult{ID: build.ID{'a'}, Stdout: []byte("OK")},
+			want:   &api.JobResult{ID: build.ID{'a'}, Stdout: []byte("OK")},
+		},
+		{
+			name:   "non retryable failure wins",
+			second: &api.JobResult{ID: build.ID{'a'}, Error: &errorText, Retryable: true},
+			want:   &api.JobResult{ID: build.ID{'a'}, ExitCode: 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newScheduler(t)
+
+			pending := s.ScheduleJob(newJob('a', build.Resources{}), scheduler.Owner{}, scheduler.Priority{})
+			require.Equal(t, build.ID{'a'}, pick(t, s, scheduler.WorkerInfo{ID: "first"}))
+			require.NotNil(t, s.SpeculateJob(pending))
+			require.Equal(t, build.ID{'a'}, pick(t, s, scheduler.WorkerInfo{ID: "second"}))
+
+			s.OnJobComplete("first", build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}, ExitCode: 1})
+
+			select {
+			case <-pending.Finished:
+				t.Fatal("failure is accepted while the other attempt is running")
+			default:
+			}
+
+			s.OnJobComplete("second", build.ID{'a'}, tc.second)
+
+			<-pending.Finished
+			require.Equal(t, tc.want, pending.Result)
+			require.Empty(t, s.TakeCancellations("first"))
+			require.Empty(t, s.TakeCancellations("second"))
+		})
+	}
+
+	// Retryable failure is accepted, when no other attempt runs.
+	s := newScheduler(t)
+
+	pending := s.ScheduleJob(newJob('a', build.Resources{}), scheduler.Owner{}, scheduler.Priority{})
+	require.Equal(t, build.ID{'a'}, pick(t, s, scheduler.WorkerInfo{ID: "first"}))
+	require.NotNil(t, s.SpeculateJob(pending))
+
+	s.OnJobComplete("first", build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}, Error: &errorText, Retryable: true})
+	<-pending.Finished
+	require.True(t, pending.Result.Retryable)
+	require.Equal(t, build.ID{}, pick(t, s, scheduler.WorkerInfo{ID: "second"}))
+}
+
+func TestArtifactHolders(t *testing.T) {
+	s := newScheduler(t)
+
+	id := build.ID{'a'}
+	s.ScheduleJob(newJob('a', build.Resources{}), scheduler.Owner{}, scheduler.Priority{})
+
+	s.AddArtifact(id, "downloader")
+	s.OnJobComplete("builder", id, &api.JobResult{ID: id})
+	s.AddArtifact(id, "other")
+	s.AddArtifact(id, "downloader")
+
+	require.Equal(t, []api.WorkerID{"builder", "downloader", "other"}, s.ArtifactHolders(id))
+
+	s.RemoveArtifact(id, "builder")
+	worker, ok := s.LocateArtifact(id)
+	require.True(t, ok)
+	require.Equal(t, api.WorkerID("downloader"), worker)
+
+	// The last holder is kept, so that the artifact can still be downloaded.
+	s.RemoveArtifact(id, "downloader")
+	s.RemoveArtifact(id, "other")
+	require.Equal(t, []api.WorkerID{"other"}, s.ArtifactHolders(id))
+}
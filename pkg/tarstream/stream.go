@@ -2,9 +2,11 @@ package tarstream
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // Send рекурсивно обходит директорию и сериализует её содержимое в поток w.
@@ -33,38 +35,129 @@ func Send(dir string, w io.Writer) error {
 			})
 
 		default:
-			h := &tar.Header{
-				Typeflag: tar.TypeReg,
-				Name:     rel,
-				Size:     info.Size(),
-				Mode:     int64(info.Mode()),
+			return writeFile(tw, path, rel, info)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// SendPaths сериализует в поток w только перечисленные пути внутри dir.
+//
+// Пути задаются относительно dir. Директории передаются целиком, вместе с родительскими
+// директориями каждого пути. Поток читается тем же Receive.
+func SendPaths(dir string, paths []string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	sent := map[string]bool{}
+
+	writeDir := func(rel string) error {
+		if sent[rel] {
+			return nil
+		}
+		sent[rel] = true
+
+		return tw.WriteHeader(&tar.Header{
+			Name:     rel,
+			Typeflag: tar.TypeDir,
+		})
+	}
+
+	for _, p := range paths {
+		p = filepath.Clean(p)
+
+		var parents []string
+		for parent := filepath.Dir(p); parent != "."; parent = filepath.Dir(parent) {
+			parents = append(parents, parent)
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			if err := writeDir(parents[i]); err != nil {
+				return err
 			}
+		}
 
-			if err := tw.WriteHeader(h); err != nil {
+		err := filepath.Walk(filepath.Join(dir, p), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
 				return err
 			}
 
-			f, err := os.Open(path)
+			rel, err := filepath.Rel(dir, path)
 			if err != nil {
 				return err
 			}
-			defer f.Close()
 
-			_, err = io.Copy(tw, f)
+			if info.IsDir() {
+				return writeDir(rel)
+			}
+
+			if sent[rel] {
+				return nil
+			}
+			sent[rel] = true
+
+			return writeFile(tw, path, rel, info)
+		})
+
+		if err != nil {
 			return err
 		}
-	})
+	}
 
+	return tw.Close()
+}
+
+// writeFile writes regular file or symlink at path into tw under name rel.
+func writeFile(tw *tar.Writer, path, rel string, info os.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     rel,
+			Linkname: target,
+		})
+	}
+
+	h := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     rel,
+		Size:     info.Size(),
+		Mode:     int64(info.Mode()),
+	}
+
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	return tw.Close()
+	_, err = io.Copy(tw, f)
+	return err
 }
 
 // Receive читает поток r и материализует содержимое потока внутри dir.
+//
+// Записи, выходящие за пределы dir или лежащие под симлинком из того же потока, отклоняются.
+// Симлинки могут указывать только вниз: абсолютные цели и цели с ".." тоже отклоняются.
 func Receive(dir string, r io.Reader) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
 	tr := tar.NewReader(r)
+	symlinks := map[string]bool{}
 
 	for {
 		h, err := tr.Next()
@@ -74,15 +167,34 @@ func Receive(dir string, r io.Reader) error {
 			return err
 		}
 
-		absPath := filepath.Join(dir, h.Name)
+		if !filepath.IsLocal(h.Name) {
+			return fmt.Errorf("tarstream: entry %q is outside of the directory", h.Name)
+		}
+		name := filepath.Clean(h.Name)
+
+		for parent := filepath.Dir(name); parent != "."; parent = filepath.Dir(parent) {
+			if symlinks[parent] {
+				return fmt.Errorf("tarstream: entry %q is under symlink %q", h.Name, parent)
+			}
+		}
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := root.Mkdir(name, 0777); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !localLink(h.Linkname) {
+				return fmt.Errorf("tarstream: symlink %q points outside of the directory: %q", h.Name, h.Linkname)
+			}
 
-		if h.Typeflag == tar.TypeDir {
-			if err := os.Mkdir(absPath, 0777); err != nil {
+			if err := root.Symlink(h.Linkname, name); err != nil {
 				return err
 			}
-		} else {
+			symlinks[name] = true
+		default:
 			writeFile := func() error {
-				f, err := os.OpenFile(absPath, os.O_CREATE|os.O_WRONLY, os.FileMode(h.Mode))
+				f, err := root.OpenFile(name, os.O_CREATE|os.O_WRONLY, os.FileMode(h.Mode))
 				if err != nil {
 					return err
 				}
@@ -98,3 +210,17 @@ func Receive(dir string, r io.Reader) error {
 		}
 	}
 }
+
+// localLink reports whether symlink target is relative and never goes up.
+func localLink(target string) bool {
+	if target == "" || filepath.IsAbs(target) {
+		return false
+	}
+
+	for _, elem := range strings.Split(filepath.ToSlash(target), "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package tarstream_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"os"
 	"path/filepath"
@@ -61,6 +62,134 @@ func TestTarStream(t *testing.T) {
 	checkFile(filepath.Join(to, "b", "c", "y.txt"), []byte("yyy"), 0644)
 }
 
+func TestTarStreamPaths(t *testing.T) {
+	from := t.TempDir()
+	to := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(from, "lib", "sub"), 0777))
+	require.NoError(t, os.MkdirAll(filepath.Join(from, "include"), 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(from, "lib", "a.a"), []byte("aaa"), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(from, "lib", "b.a"), []byte("bbb"), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(from, "lib", "sub", "c.a"), []byte("ccc"), 0666))
+	require.NoError(t, os.WriteFile(filepath.Join(from, "include", "a.h"), []byte("hhh"), 0666))
+
+	var buf bytes.Buffer
+	require.NoError(t, tarstream.SendPaths(from, []string{"lib/sub/c.a", "include", "lib/sub", "lib/a.a"}, &buf))
+	require.NoError(t, tarstream.Receive(to, &buf))
+
+	var files []string
+	require.NoError(t, filepath.Walk(to, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(to, path)
+			files = append(files, rel)
+		}
+		return err
+	}))
+	require.Equal(t, []string{"include/a.h", "lib/a.a", "lib/sub/c.a"}, files)
+
+	content, err := os.ReadFile(filepath.Join(to, "lib", "sub", "c.a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("ccc"), content)
+}
+
+func TestTarStreamSymlinks(t *testing.T) {
+	from := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(from, "lib"), 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(from, "lib", "libfoo.so.1"), []byte("elf"), 0666))
+	require.NoError(t, os.Symlink("libfoo.so.1", filepath.Join(from, "lib", "libfoo.so")))
+	require.NoError(t, os.Symlink("lib", filepath.Join(from, "current")))
+
+	checkLinks := func(to string) {
+		t.Helper()
+
+		target, err := os.Readlink(filepath.Join(to, "lib", "libfoo.so"))
+		require.NoError(t, err)
+		require.Equal(t, "libfoo.so.1", target)
+
+		content, err := os.ReadFile(filepath.Join(to, "lib", "libfoo.so"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("elf"), content)
+
+		target, err = os.Readlink(filepath.Join(to, "current"))
+		require.NoError(t, err)
+		require.Equal(t, "lib", target)
+	}
+
+	var buf bytes.Buffer
+	to := t.TempDir()
+	require.NoError(t, tarstream.Send(from, &buf))
+	require.NoError(t, tarstream.Receive(to, &buf))
+	checkLinks(to)
+
+	buf.Reset()
+	to = t.TempDir()
+	require.NoError(t, tarstream.SendPaths(from, []string{"lib", "current"}, &buf))
+	require.NoError(t, tarstream.Receive(to, &buf))
+	checkLinks(to)
+}
+
+func TestTarStreamRejectsEscapes(t *testing.T) {
+	type entry struct {
+		name, link, content string
+		typ                 byte
+	}
+
+	for _, tc := range []struct {
+		name    string
+		entries []entry
+	}{
+		{
+			name:    "dot dot name",
+			entries: []entry{{name: "../escape", typ: tar.TypeReg, content: "x"}},
+		},
+		{
+			name:    "absolute target",
+			entries: []entry{{name: "x", typ: tar.TypeSymlink, link: "/"}},
+		},
+		{
+			name:    "dot dot target",
+			entries: []entry{{name: "x", typ: tar.TypeSymlink, link: "a/../../.."}},
+		},
+		{
+			name: "file under symlink",
+			entries: []entry{
+				{name: "sub", typ: tar.TypeDir},
+				{name: "x", typ: tar.TypeSymlink, link: "sub"},
+				{name: "x/escape", typ: tar.TypeReg, content: "x"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, e := range tc.entries {
+				require.NoError(t, tw.WriteHeader(&tar.Header{
+					Name:     e.name,
+					Linkname: e.link,
+					Typeflag: e.typ,
+					Size:     int64(len(e.content)),
+					Mode:     0666,
+				}))
+				_, err := tw.Write([]byte(e.content))
+				require.NoError(t, err)
+			}
+			require.NoError(t, tw.Close())
+
+			parent := t.TempDir()
+			to := filepath.Join(parent, "to")
+			require.NoError(t, os.Mkdir(to, 0777))
+
+			require.Error(t, tarstream.Receive(to, &buf))
+
+			_, err := os.Lstat(filepath.Join(parent, "escape"))
+			require.True(t, os.IsNotExist(err))
+			_, err = os.Lstat(filepath.Join(to, "sub", "escape"))
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
 func init() {
 	unix.Umask(0022)
 }
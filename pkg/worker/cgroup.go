@@ -0,0 +1,12 @@
+//go:build !solution
+
+package worker
+
+// CgroupConfig задаёт настройки ограничения ресурсов джобов через cgroup v2.
+type CgroupConfig struct {
+	// Root задаёт директорию cgroup v2, делегированную воркеру.
+	//
+	// Воркер создаёт в ней по одной дочерней cgroup на каждый джоб. В самой Root не должно быть
+	// процессов, иначе ядро не позволит включить контроллеры для дочерних cgroup.
+	Root string
+}
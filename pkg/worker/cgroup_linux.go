@@ -0,0 +1,204 @@
+//go:build !solution && linux
+
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+const cgroup2SuperMagic = 0x63677270
+
+// cgroupPeriod задаёт период, в рамках которого cpu.max ограничивает процессорное время.
+const cgroupPeriod = 100 * time.Millisecond
+
+type cgroupManager struct {
+	root        string
+	logger      *zap.Logger
+	controllers map[string]bool
+}
+
+// newCgroupManager checks that config.Root is usable and enables controllers for job cgroups.
+//
+// It returns nil if cgroups are not configured or not available, so jobs run without limits.
+func newCgroupManager(config *CgroupConfig, log *zap.Logger) *cgroupManager {
+	if config == nil {
+		return nil
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(config.Root, &stat); err != nil || stat.Type != cgroup2SuperMagic {
+		log.Warn("cgroup v2 is not available, running jobs without resource limits",
+			zap.String("root", config.Root), zap.Error(err))
+		return nil
+	}
+
+	m := &cgroupManager{
+		root:        config.Root,
+		logger:      log,
+		controllers: map[string]bool{},
+	}
+
+	available, err := os.ReadFile(filepath.Join(config.Root, "cgroup.controllers"))
+	if err != nil {
+		log.Warn("cgroup is not readable, running jobs without resource limits", zap.Error(err))
+		return nil
+	}
+
+	subtreeControl := filepath.Join(config.Root, "cgroup.subtree_control")
+	for _, controller := range strings.Fields(string(available)) {
+		if controller != "cpu" && controller != "memory" && controller != "pids" {
+			continue
+		}
+
+		if err := os.WriteFile(subtreeControl, []byte("+"+controller), 0); err != nil {
+			log.Warn("failed to enable cgroup controller", zap.String("controller", controller), zap.Error(err))
+			continue
+		}
+		m.controllers[controller] = true
+	}
+
+	return m
+}
+
+type jobCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// create makes cgroup for a single job and applies its limits.
+//
+// Limits that require unavailable controllers are skipped with a warning.
+func (m *cgroupManager) create(id build.ID, res build.Resources) (*jobCgroup, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	path, err := os.MkdirTemp(m.root, "job-"+id.String()+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	limits := []struct {
+		controller string
+		file       string
+		value      string
+	}{
+		{"cpu", "cpu.max", fmt.Sprintf("%d %d", res.MilliCPU*cgroupPeriod.Microseconds()/1000, cgroupPeriod.Microseconds())},
+		{"memory", "memory.max", strconv.FormatInt(res.Memory, 10)},
+		{"memory", "memory.swap.max", "0"},
+		{"pids", "pids.max", strconv.FormatInt(res.Pids, 10)},
+	}
+
+	for _, l := range limits {
+		switch {
+		case l.controller == "cpu" && res.MilliCPU == 0:
+			continue
+		case l.controller == "memory" && res.Memory == 0:
+			continue
+		case l.controller == "pids" && res.Pids == 0:
+			continue
+		}
+
+		if !m.controllers[l.controller] {
+			m.logger.Warn("cgroup controller is not available, limit is ignored",
+				zap.String("job", id.String()), zap.String("limit", l.file))
+			continue
+		}
+
+		err := os.WriteFile(filepath.Join(path, l.file), []byte(l.value), 0)
+		if err != nil && !os.IsNotExist(err) {
+			_ = os.Remove(path)
+			return nil, fmt.Errorf("set %s: %w", l.file, err)
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	return &jobCgroup{path: path, dir: dir}, nil
+}
+
+func (g *jobCgroup) attach(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(g.dir.Fd())
+}
+
+// usage returns resources consumed by all processes that ever ran in the cgroup.
+//
+// PeakRSS is zero when memory controller is not enabled.
+func (g *jobCgroup) usage() api.ResourceUsage {
+	var usage api.ResourceUsage
+
+	if usec, ok := readKeyedValue(filepath.Join(g.path, "cpu.stat"), "usage_usec"); ok {
+		usage.CPUTime = time.Duration(usec) * time.Microsecond
+	}
+
+	if peak, err := os.ReadFile(filepath.Join(g.path, "memory.peak")); err == nil {
+		usage.PeakRSS, _ = strconv.ParseInt(strings.TrimSpace(string(peak)), 10, 64)
+	}
+
+	return usage
+}
+
+// oomKilled reports whether kernel killed any process of the job because of memory limit.
+func (g *jobCgroup) oomKilled() bool {
+	n, ok := readKeyedValue(filepath.Join(g.path, "memory.events"), "oom_kill")
+	return ok && n > 0
+}
+
+// remove kills processes left in the cgroup and removes it.
+func (g *jobCgroup) remove() error {
+	_ = os.WriteFile(filepath.Join(g.path, "cgroup.kill"), []byte("1"), 0)
+	_ = g.dir.Close()
+
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(g.path); err == nil {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+func readKeyedValue(path, key string) (int64, bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			v, err := strconv.ParseInt(fields[1], 10, 64)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
+
+func processUsage(state *os.ProcessState) api.ResourceUsage {
+	usage := api.ResourceUsage{CPUTime: state.UserTime() + state.SystemTime()}
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// На Linux ru_maxrss измеряется в килобайтах.
+		usage.PeakRSS = rusage.Maxrss * 1024
+	}
+	return usage
+}
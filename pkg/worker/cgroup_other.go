@@ -0,0 +1,46 @@
+//go:build !solution && !linux
+
+package worker
+
+import (
+	"os"
+	"syscall"
+
+	"go.uber.org/zap"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+type cgroupManager struct{}
+
+func newCgroupManager(config *CgroupConfig, log *zap.Logger) *cgroupManager {
+	if config != nil {
+		log.Warn("cgroups are supported only on linux, running jobs without resource limits")
+	}
+	return nil
+}
+
+type jobCgroup struct{}
+
+func (m *cgroupManager) create(id build.ID, res build.Resources) (*jobCgroup, error) {
+	return nil, nil
+}
+
+func (g *jobCgroup) attach(attr *syscall.SysProcAttr) {}
+
+func (g *jobCgroup) usage() api.ResourceUsage {
+	return api.ResourceUsage{}
+}
+
+func (g *jobCgroup) oomKilled() bool {
+	return false
+}
+
+func (g *jobCgroup) remove() error {
+	return nil
+}
+
+func processUsage(state *os.ProcessState) api.ResourceUsage {
+	return api.ResourceUsage{CPUTime: state.UserTime() + state.SystemTime()}
+}
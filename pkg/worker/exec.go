@@ -0,0 +1,125 @@
+//go:build !solution
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+)
+
+// KillGracePeriod задаёт, сколько времени процессы команды получают на завершение
+// между SIGTERM и SIGKILL, когда команда превысила таймаут.
+var KillGracePeriod = 5 * time.Second
+
+type execOptions struct {
+	Argv []string
+	Env  []string
+	Dir  string
+
+	// Sandbox задаёт песочницу для команды. Если nil, команда запускается прямо на хосте.
+	Sandbox *sandboxSpec
+
+	// Cgroup задаёт cgroup джоба, в которую помещается процесс команды.
+	Cgroup *jobCgroup
+
+	// Stdout и Stderr получают вывод команды по мере его появления. Если nil, вывод отбрасывается.
+	Stdout, Stderr io.Writer
+}
+
+type execResult struct {
+	ExitCode int
+	TimedOut bool
+	Usage    api.ResourceUsage
+}
+
+// runExec runs command in its own process group and waits for it to exit.
+//
+// When ctx expires, the whole process group receives SIGTERM, followed by SIGKILL
+// after KillGracePeriod. Returned error is non-nil only if the command could not be run;
+// non-zero exit codes and timeouts are reported in execResult.
+func runExec(ctx context.Context, opts *execOptions) (*execResult, error) {
+	cmd := exec.CommandContext(ctx, opts.Argv[0], opts.Argv[1:]...)
+	cmd.Env = opts.Env
+	cmd.Dir = opts.Dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if opts.Sandbox != nil {
+		spec := *opts.Sandbox
+		spec.Argv = opts.Argv
+		spec.Env = opts.Env
+		spec.Dir = opts.Dir
+
+		cleanup, err := prepareSandbox(cmd, &spec)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+	}
+
+	if opts.Cgroup != nil {
+		opts.Cgroup.attach(cmd.SysProcAttr)
+	}
+
+	var (
+		killMutex sync.Mutex
+		killTimer *time.Timer
+	)
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+
+		killMutex.Lock()
+		killTimer = time.AfterFunc(KillGracePeriod, func() {
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		killMutex.Unlock()
+
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+
+	// os/exec читает оба потока одновременно в отдельных горутинах, а Wait дожидается, пока они
+	// дочитают. Иначе команда, заполнившая буфер одного канала, блокируется, пока читают другой.
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+
+	// Фоновый процесс, сбежавший из группы, может держать каналы открытыми после завершения команды.
+	cmd.WaitDelay = KillGracePeriod
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var res execResult
+	err := cmd.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+
+	killMutex.Lock()
+	if killTimer != nil {
+		killTimer.Stop()
+	}
+	killMutex.Unlock()
+
+	if ctx.Err() != nil {
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ctx.Err()
+		}
+		res.TimedOut = true
+	}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) && !res.TimedOut {
+		return nil, err
+	}
+
+	res.ExitCode = cmd.ProcessState.ExitCode()
+	res.Usage = processUsage(cmd.ProcessState)
+	return &res, nil
+}
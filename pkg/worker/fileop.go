@@ -0,0 +1,182 @@
+//go:build !solution
+
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// confineFileOp checks that the rendered file operation changes only files inside of writable
+// directories and copies only from readable ones.
+//
+// Paths are resolved through symlinks before the check. Returned command refers to the resolved
+// paths, so that the operation can't be redirected by a symlink afterwards.
+func confineFileOp(cmd *build.Cmd, writable, readable []string) (*build.Cmd, error) {
+	kind, err := cmd.Kind()
+	if err != nil {
+		return nil, err
+	}
+
+	writable, err = resolveRoots(writable)
+	if err != nil {
+		return nil, err
+	}
+	readable, err = resolveRoots(readable)
+	if err != nil {
+		return nil, err
+	}
+
+	// check resolves path and makes sure it stays inside of roots. The last element of the path
+	// is not resolved for operations that work on the link itself.
+	check := func(op, path string, roots []string, followLast, allowRoot bool) (string, error) {
+		resolved, err := resolvePath(path, followLast)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+		if !insideRoots(resolved, roots, allowRoot) {
+			return "", fmt.Errorf("%s: path %q is outside of the job directories", op, path)
+		}
+		return resolved, nil
+	}
+
+	confined := *cmd
+	switch kind {
+	case build.CmdCat:
+		confined.CatOutput, err = check("cat", cmd.CatOutput, writable, true, false)
+
+	case build.CmdCopy:
+		confined.CopySource, err = check("copy", cmd.CopySource, readable, true, false)
+		if err == nil {
+			confined.CopyOutput, err = check("copy", cmd.CopyOutput, writable, true, false)
+		}
+
+	case build.CmdMkdir:
+		confined.MkdirPath, err = check("mkdir", cmd.MkdirPath, writable, true, true)
+
+	case build.CmdSymlink:
+		confined.SymlinkOutput, err = check("symlink", cmd.SymlinkOutput, writable, false, false)
+
+	case build.CmdRemove:
+		confined.RemovePath, err = check("remove", cmd.RemovePath, writable, false, false)
+
+	default:
+		return nil, fmt.Errorf("%s cmd is not a file operation", kind)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &confined, nil
+}
+
+func resolveRoots(roots []string) ([]string, error) {
+	resolved := make([]string, 0, len(roots))
+	for _, root := range roots {
+		real, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, real)
+	}
+	return resolved, nil
+}
+
+// resolvePath resolves symlinks in the existing part of the absolute path.
+//
+// Elements of the path that don't exist yet are appended as is. Dangling symlinks are rejected,
+// because writing through them creates files wherever they point to.
+func resolvePath(path string, followLast bool) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("path %q is not absolute", path)
+	}
+	path = filepath.Clean(path)
+
+	if !followLast {
+		dir, err := resolvePath(filepath.Dir(path), true)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, filepath.Base(path)), nil
+	}
+
+	existing, rest := path, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", fmt.Errorf("resolve %q: %w", existing, err)
+	}
+	return filepath.Join(real, rest), nil
+}
+
+// insideRoots reports whether path is inside of one of roots. The root itself matches only if allowRoot is set.
+func insideRoots(path string, roots []string, allowRoot bool) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			continue
+		}
+		if rel == "." {
+			if allowRoot {
+				return true
+			}
+			continue
+		}
+		if filepath.IsLocal(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// runFileOp runs confined file operation of the job, inside of the sandbox if it is enabled.
+func (w *Worker) runFileOp(ctx context.Context, cmd *build.Cmd, sourceDir, outputDir, tmpDir string, deps map[build.ID]string) error {
+	readable := []string{sourceDir}
+	for _, dir := range deps {
+		readable = append(readable, dir)
+	}
+
+	confined, err := confineFileOp(cmd, []string{outputDir, tmpDir}, readable)
+	if err != nil {
+		return err
+	}
+
+	spec := w.sandboxSpec(sourceDir, outputDir, tmpDir, deps)
+	if spec == nil {
+		return confined.RunFileOp()
+	}
+
+	spec.FileOp = confined
+
+	var stderr bytes.Buffer
+	out, err := runExec(ctx, &execOptions{
+		Argv:    []string{"distbuild-fileop"},
+		Env:     []string{},
+		Sandbox: spec,
+		Stderr:  &stderr,
+	})
+	if err != nil {
+		return err
+	}
+	if out.ExitCode != 0 {
+		return errors.New(strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
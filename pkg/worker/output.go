@@ -0,0 +1,229 @@
+//go:build !solution
+
+package worker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// DefaultMaxInlineOutput задаёт размер вывода, который воркер по умолчанию передаёт прямо в JobResult.
+const DefaultMaxInlineOutput = 1 << 20
+
+// logStore хранит полный вывод джобов, который не поместился в JobResult.
+//
+// Для каждого джоба хранится только вывод последнего запуска.
+type logStore struct {
+	dir    string
+	logger *zap.Logger
+
+	// temporary означает, что dir создал сам воркер, и она удаляется после завершения Run.
+	temporary bool
+}
+
+func (s *logStore) path(id build.ID, stream string) string {
+	return filepath.Join(s.dir, id.String()+"."+stream)
+}
+
+func (s *logStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var id build.ID
+	if err := id.UnmarshalText([]byte(r.URL.Query().Get("id"))); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stream := r.URL.Query().Get("stream")
+	if stream != "stdout" && stream != "stderr" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(s.path(id, stream))
+	if errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.logger.Error("failed to open job log", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = io.Copy(w, f)
+}
+
+func (s *logStore) Register(mux *http.ServeMux) {
+	mux.Handle("GET /log", s)
+}
+
+// outputCapture собирает один поток вывода джоба из всех его команд.
+//
+// Весь вывод сразу передаётся в forward, а первые limit байт хранятся в памяти. Если вывод длиннее,
+// он целиком записывается в файл logStore, а в памяти остаётся только начало.
+type outputCapture struct {
+	logger  *zap.Logger
+	store   *logStore
+	id      build.ID
+	stream  string
+	limit   int
+	forward io.Writer
+
+	inline []byte
+	size   int64
+	file   *os.File
+	err    error
+}
+
+// Write never fails, so that problems with log storage do not affect the command.
+func (c *outputCapture) Write(p []byte) (int, error) {
+	n := len(p)
+	c.size += int64(n)
+
+	if c.forward != nil && n != 0 {
+		_, _ = c.forward.Write(p)
+	}
+
+	if c.file == nil && c.err == nil {
+		head := p[:min(len(p), c.limit-len(c.inline))]
+		c.inline = append(c.inline, head...)
+
+		if len(head) == len(p) {
+			return n, nil
+		}
+
+		if c.store == nil {
+			c.err = errors.New("log store is not available")
+			return n, nil
+		}
+
+		p = p[len(head):]
+		if c.file, c.err = os.Create(c.store.path(c.id, c.stream)); c.err == nil {
+			_, c.err = c.file.Write(c.inline)
+		}
+	}
+
+	if c.file != nil && c.err == nil {
+		_, c.err = c.file.Write(p)
+	}
+	return n, nil
+}
+
+// finish returns inline part of the output and reference to the full log, if output was truncated.
+func (c *outputCapture) finish(worker api.WorkerID) ([]byte, *api.LogRef) {
+	if c.file != nil {
+		if err := c.file.Close(); c.err == nil {
+			c.err = err
+		}
+	}
+
+	if c.size == int64(len(c.inline)) {
+		return c.inline, nil
+	}
+
+	if c.err != nil {
+		c.logger.Warn("failed to store job output, it is truncated",
+			zap.String("job", c.id.String()), zap.String("stream", c.stream), zap.Error(c.err))
+		return c.inline, nil
+	}
+
+	return c.inline, &api.LogRef{Worker: worker, Job: c.id, Stream: c.stream, Size: c.size}
+}
+
+// combinedLog собирает stdout и stderr команд джоба в один журнал строк.
+//
+// Строки из разных потоков упорядочены по времени, когда воркер получил их начало. Журнал хранит
+// не больше limit байт текста вместе с переводами строк, остальные строки отбрасываются.
+type combinedLog struct {
+	mutex     sync.Mutex
+	limit     int
+	size      int
+	lines     []api.LogLine
+	truncated bool
+
+	// partial хранит индекс незавершённой строки каждого потока в lines.
+	partial map[string]int
+}
+
+func newCombinedLog(limit int) *combinedLog {
+	return &combinedLog{limit: limit, partial: make(map[string]int)}
+}
+
+// stream returns writer that adds output of the stream to the log.
+func (l *combinedLog) stream(name string) io.Writer {
+	return combinedLogWriter{log: l, stream: name}
+}
+
+type combinedLogWriter struct {
+	log    *combinedLog
+	stream string
+}
+
+func (w combinedLogWriter) Write(p []byte) (int, error) {
+	w.log.write(w.stream, p)
+	return len(p), nil
+}
+
+func (l *combinedLog) write(stream string, p []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for len(p) != 0 {
+		if l.truncated {
+			return
+		}
+
+		text, rest, complete := bytes.Cut(p, []byte("\n"))
+		p = rest
+
+		// Перевод строки тоже занимает место в журнале, иначе поток из одних переводов строк
+		// никогда не упрётся в limit.
+		size := len(text)
+		if complete {
+			size++
+		}
+		if l.size+size > l.limit {
+			text = text[:min(len(text), max(0, l.limit-l.size))]
+			l.truncated = true
+		}
+		l.size += size
+
+		if i, ok := l.partial[stream]; ok {
+			l.lines[i].Text += string(text)
+		} else if len(text) != 0 || (complete && !l.truncated) {
+			l.lines = append(l.lines, api.LogLine{Time: now, Stream: stream, Text: string(text)})
+			l.partial[stream] = len(l.lines) - 1
+		}
+
+		if complete {
+			delete(l.partial, stream)
+		}
+	}
+}
+
+// endCommand finishes lines left incomplete by the previous command.
+func (l *combinedLog) endCommand() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	clear(l.partial)
+}
+
+func (l *combinedLog) finish() ([]api.LogLine, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.lines, l.truncated
+}
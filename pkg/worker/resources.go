@@ -0,0 +1,74 @@
+//go:build !solution
+
+package worker
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// detectResources fills zero MilliCPU and Memory with the capacity of the machine.
+//
+// Memory stays zero if it can't be detected.
+func detectResources(res build.Resources) build.Resources {
+	if res.MilliCPU == 0 {
+		res.MilliCPU = int64(runtime.NumCPU()) * 1000
+	}
+	if res.Memory == 0 {
+		res.Memory = totalMemory()
+	}
+	return res
+}
+
+func totalMemory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// jobCPUs returns number of cores available to the job: its MilliCPU limit rounded up,
+// but no more than cores of the worker.
+func (w *Worker) jobCPUs(res build.Resources) int {
+	total := int((w.config.Resources.MilliCPU + 999) / 1000)
+	if res.MilliCPU == 0 {
+		return max(total, 1)
+	}
+	return max(min(int((res.MilliCPU+999)/1000), total), 1)
+}
+
+// freeResources returns resources of the worker not taken by its running jobs.
+//
+// Must be called with w.jobs locked.
+func (w *Worker) freeResources() build.Resources {
+	free := w.config.Resources
+	for _, running := range w.jobs.running {
+		free.MilliCPU -= running.resources.MilliCPU
+		free.Memory -= running.resources.Memory
+		free.Pids -= running.resources.Pids
+	}
+
+	free.MilliCPU = max(free.MilliCPU, 0)
+	free.Memory = max(free.Memory, 0)
+	free.Pids = max(free.Pids, 0)
+	return free
+}
@@ -0,0 +1,41 @@
+//go:build !solution
+
+package worker
+
+import "gitlab.com/slon/shad-go/distbuild/pkg/build"
+
+// SandboxConfig задаёт настройки песочницы, в которой воркер запускает команды джобов.
+//
+// Внутри песочницы видны только директория с исходным кодом и артефакты зависимостей
+// на чтение, выходная директория джоба на запись, собственный пустой /tmp и пути
+// из ToolchainPaths на чтение. Сеть внутри песочницы недоступна.
+type SandboxConfig struct {
+	// ToolchainPaths перечисляет пути хоста, которые доступны внутри песочницы только на чтение.
+	//
+	// Несуществующие пути пропускаются.
+	ToolchainPaths []string
+}
+
+var DefaultSandboxConfig = SandboxConfig{
+	ToolchainPaths: []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc"},
+}
+
+// sandboxSpec описывает одну команду, запускаемую в песочнице.
+//
+// Пути внутри песочницы совпадают с путями на хосте, поэтому отрендеренные команды
+// не нужно переписывать.
+type sandboxSpec struct {
+	Toolchain []string
+	ReadOnly  []string
+	Writable  []string
+
+	Argv []string
+	Env  []string
+	Dir  string
+
+	// Root задаёт пустую директорию хоста, которая становится корнем песочницы.
+	Root string
+
+	// FileOp задаёт файловую операцию, которую процесс песочницы выполняет сам вместо запуска Argv.
+	FileOp *build.Cmd
+}
@@ -0,0 +1,291 @@
+//go:build !solution && linux
+
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// sandboxEnv передаёт sandboxSpec процессу, который настраивает песочницу.
+const sandboxEnv = "DISTBUILD_SANDBOX_SPEC"
+
+// sandboxSetupExitCode возвращается, если песочницу не удалось настроить.
+const sandboxSetupExitCode = 125
+
+func init() {
+	if encoded, ok := os.LookupEnv(sandboxEnv); ok {
+		os.Exit(runSandboxInit(encoded))
+	}
+}
+
+// prepareSandbox makes cmd re-execute current binary inside fresh namespaces.
+//
+// Child process sets up mounts described by spec and runs the real command.
+// Returned cleanup must be called after cmd exits.
+func prepareSandbox(cmd *exec.Cmd, spec *sandboxSpec) (cleanup func(), err error) {
+	spec.Root, err = os.MkdirTemp("", "sandbox")
+	if err != nil {
+		return nil, err
+	}
+	cleanup = func() { _ = os.Remove(spec.Root) }
+
+	if spec.Env == nil {
+		spec.Env = os.Environ()
+	}
+
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = []string{"distbuild-sandbox"}
+	cmd.Env = []string{sandboxEnv + "=" + string(encoded)}
+	cmd.Dir = ""
+	cmd.Err = nil
+
+	// Команда работает от root внутри user namespace, а на хосте это всё ещё пользователь воркера.
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+		syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+
+	return cleanup, nil
+}
+
+// runSandboxInit runs as pid 1 of the sandbox and returns its exit code.
+func runSandboxInit(encoded string) int {
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(encoded), &spec); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		return sandboxSetupExitCode
+	}
+
+	if err := spec.setup(); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		return sandboxSetupExitCode
+	}
+
+	os.Clearenv()
+	for _, kv := range spec.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			_ = os.Setenv(k, v)
+		}
+	}
+
+	if spec.FileOp != nil {
+		if err := spec.FileOp.RunFileOp(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	cmd := exec.Command(spec.Argv[0], spec.Argv[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Ядро не доставляет pid 1 сигналы без обработчика, поэтому пересылаем их команде сами.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		return sandboxSetupExitCode
+	}
+
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		return sandboxSetupExitCode
+	}
+
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+type sandboxMount struct {
+	path      string
+	readOnly  bool
+	toolchain bool
+}
+
+func (s *sandboxSpec) setup() error {
+	// Не даём монтированиям песочницы попасть в mount namespace хоста.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make / private: %w", err)
+	}
+
+	if err := syscall.Mount("tmpfs", s.Root, "tmpfs", 0, "mode=755"); err != nil {
+		return fmt.Errorf("mount root: %w", err)
+	}
+
+	tmp := filepath.Join(s.Root, "tmp")
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", tmp, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mount /tmp: %w", err)
+	}
+
+	var mounts []sandboxMount
+	for _, path := range s.Toolchain {
+		mounts = append(mounts, sandboxMount{path: path, readOnly: true, toolchain: true})
+	}
+	for _, path := range s.ReadOnly {
+		mounts = append(mounts, sandboxMount{path: path, readOnly: true})
+	}
+	for _, path := range s.Writable {
+		mounts = append(mounts, sandboxMount{path: path})
+	}
+
+	// Родительские директории монтируются раньше вложенных, иначе вложенные окажутся перекрыты.
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return len(filepath.Clean(mounts[i].path)) < len(filepath.Clean(mounts[j].path))
+	})
+
+	for _, m := range mounts {
+		if err := s.bind(m); err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom"} {
+		if err := s.bind(sandboxMount{path: dev}); err != nil {
+			return err
+		}
+	}
+
+	proc := filepath.Join(s.Root, "proc")
+	if err := os.MkdirAll(proc, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount /proc: %w", err)
+	}
+
+	oldRoot := filepath.Join(s.Root, ".oldroot")
+	if err := os.MkdirAll(oldRoot, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(s.Root, oldRoot); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.oldroot", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount old root: %w", err)
+	}
+	if err := os.Remove("/.oldroot"); err != nil {
+		return err
+	}
+
+	if s.Dir != "" {
+		if err := os.Chdir(s.Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sandboxSpec) bind(m sandboxMount) error {
+	target := filepath.Join(s.Root, m.path)
+
+	info, err := os.Lstat(m.path)
+	if err != nil {
+		if m.toolchain && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0 && m.toolchain:
+		// Например, /bin -> usr/bin. Ссылка ведёт внутрь песочницы, если туда смонтирована её цель.
+		link, err := os.Readlink(m.path)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+
+	case info.IsDir():
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+
+	default:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		_ = f.Close()
+	}
+
+	if err := syscall.Mount(m.path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind %s: %w", m.path, err)
+	}
+
+	if !m.readOnly {
+		return nil
+	}
+
+	// Внутри user namespace нельзя снять флаги, унаследованные от хоста, поэтому сохраняем их.
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(target, &stat); err != nil {
+		return err
+	}
+
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, f := range []uintptr{
+		syscall.MS_NOSUID, syscall.MS_NODEV, syscall.MS_NOEXEC,
+		syscall.MS_NOATIME, syscall.MS_NODIRATIME, syscall.MS_RELATIME,
+	} {
+		if mountFlagSet(stat.Flags, f) {
+			flags |= f
+		}
+	}
+
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %w", m.path, err)
+	}
+	return nil
+}
+
+// mountFlagSet checks statfs flags against MS_* constant.
+//
+// ST_* and MS_* values coincide for all flags except MS_RELATIME.
+func mountFlagSet(statFlags int64, flag uintptr) bool {
+	const stRelatime = 0x1000
+	if flag == syscall.MS_RELATIME {
+		return statFlags&stRelatime != 0
+	}
+	return statFlags&int64(flag) != 0
+}
@@ -0,0 +1,12 @@
+//go:build !solution && !linux
+
+package worker
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func prepareSandbox(cmd *exec.Cmd, spec *sandboxSpec) (cleanup func(), err error) {
+	return nil, errors.New("sandbox is supported only on linux")
+}
@@ -4,12 +4,15 @@ package worker
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -19,24 +22,101 @@ import (
 	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
 )
 
+// Config задаёт настройки воркера.
+type Config struct {
+	// Sandbox включает изоляцию команд джобов. Если nil, команды запускаются прямо на хосте.
+	Sandbox *SandboxConfig
+
+	// Cgroup включает ограничение ресурсов джобов. Если nil или cgroup v2 недоступна,
+	// джобы запускаются без ограничений.
+	Cgroup *CgroupConfig
+
+	// Resources задаёт ресурсы воркера, о которых он сообщает координатору.
+	//
+	// Нулевые MilliCPU и Memory определяются по числу ядер и объёму памяти машины.
+	Resources build.Resources
+
+	// Labels задаёт метки воркера, которые проверяются при размещении джобов с build.Job.Constraints.
+	Labels map[string]string
+
+	// MaxInlineOutput ограничивает размер JobResult.Stdout и JobResult.Stderr. Более длинный вывод
+	// сохраняется в LogDir, и его можно скачать по ссылке из JobResult.StdoutLog и JobResult.StderrLog.
+	//
+	// Нулевое значение означает DefaultMaxInlineOutput.
+	MaxInlineOutput int
+
+	// LogDir задаёт директорию для полного вывода джобов. Если пусто, воркер создаёт временную директорию
+	// и удаляет её, когда Run завершается.
+	LogDir string
+
+	// EnvPassthrough перечисляет переменные окружения воркера, которые передаются командам джобов.
+	//
+	// Остальное окружение воркера командам не видно, см. jobEnviron.
+	EnvPassthrough []string
+}
+
 type Worker struct {
 	workerID        api.WorkerID
 	coordEndpoint   string
 	logger          *zap.Logger
 	fileCache       *filecache.Cache
 	artifacts       *artifact.Cache
+	downloads       *artifact.Downloader
 	heartbeatClient *api.HeartbeatClient
 	filecacheClient *filecache.Client
+	config          Config
+	cgroups         *cgroupManager
+	logs            *logStore
 
 	mux *http.ServeMux
+
+	// jobs хранит состояние джобов между heartbeat-ами.
+	jobs struct {
+		sync.Mutex
+		running        map[build.ID]*runningJob
+		finished       []api.JobResult
+		addedArtifacts []build.ID
+		canceled       []build.ID
+		output         []api.JobOutput
+		badSources     []api.ArtifactSource
+
+		// done получает сигнал, когда завершается очередной джоб.
+		done chan struct{}
+		wg   sync.WaitGroup
+	}
 }
 
+// runningJob описывает джоб, который сейчас выполняется на воркере.
+type runningJob struct {
+	cancel   context.CancelFunc
+	canceled bool
+
+	// resources задаёт ресурсы, занятые джобом.
+	resources build.Resources
+}
+
+// HeartbeatInterval задаёт, как часто воркер ходит к координатору, пока все его слоты заняты.
+//
+// Пока есть свободные слоты, heartbeat блокируется на координаторе до появления нового джоба.
+var HeartbeatInterval = 100 * time.Millisecond
+
 func New(
 	workerID api.WorkerID,
 	coordinatorEndpoint string,
 	log *zap.Logger,
 	fileCache *filecache.Cache,
 	artifacts *artifact.Cache,
+) *Worker {
+	return NewWithConfig(workerID, coordinatorEndpoint, log, fileCache, artifacts, Config{})
+}
+
+func NewWithConfig(
+	workerID api.WorkerID,
+	coordinatorEndpoint string,
+	log *zap.Logger,
+	fileCache *filecache.Cache,
+	artifacts *artifact.Cache,
+	config Config,
 ) *Worker {
 	var worker Worker
 	worker.workerID = workerID
@@ -44,12 +124,38 @@ func New(
 	worker.logger = log
 	worker.fileCache = fileCache
 	worker.artifacts = artifacts
+	worker.downloads = artifact.NewDownloader(artifacts)
+	worker.config = config
+	worker.config.Resources = detectResources(config.Resources)
+	worker.cgroups = newCgroupManager(config.Cgroup, log)
 	worker.heartbeatClient = api.NewHeartbeatClient(log, coordinatorEndpoint)
 	worker.filecacheClient = filecache.NewClient(log, coordinatorEndpoint)
 	worker.mux = http.NewServeMux()
+	worker.jobs.running = make(map[build.ID]*runningJob)
+	worker.jobs.done = make(chan struct{}, 1)
+
+	if worker.config.MaxInlineOutput == 0 {
+		worker.config.MaxInlineOutput = DefaultMaxInlineOutput
+	}
+
+	if config.LogDir == "" {
+		dir, err := os.MkdirTemp("", "distbuild-logs")
+		if err != nil {
+			log.Warn("failed to create log directory, long job output will be truncated", zap.Error(err))
+		} else {
+			worker.logs = &logStore{dir: dir, logger: log, temporary: true}
+		}
+	} else if err := os.MkdirAll(config.LogDir, 0755); err != nil {
+		log.Warn("failed to create log directory, long job output will be truncated", zap.Error(err))
+	} else {
+		worker.logs = &logStore{dir: config.LogDir, logger: log}
+	}
 
 	artifactHandler := artifact.NewHandler(log, artifacts)
 	artifactHandler.Register(worker.mux)
+	if worker.logs != nil {
+		worker.logs.Register(worker.mux)
+	}
 
 	return &worker
 }
@@ -69,180 +175,524 @@ func EnsureBaseDir(fpath string) error {
 
 func (w *Worker) downloadSourceFiles(ctx context.Context, job *api.JobSpec, destDir string) error {
 	for id, newFile := range job.SourceFiles {
-		err := w.filecacheClient.Download(ctx, w.fileCache, id)
-		if err != nil {
+		if err := w.filecacheClient.Download(ctx, w.fileCache, id); err != nil {
 			return err
 		}
-		path, unlock, innerErr := w.fileCache.Get(id)
-		err = innerErr
-		if err != nil {
+
+		if err := w.copySourceFile(id, filepath.Join(destDir, newFile)); err != nil {
 			return err
 		}
-		w.logger.Sugar().Infof("ok get")
+	}
+	return nil
+}
 
-		source, innerErr := os.Open(path)
-		err = innerErr
-		if err != nil {
+// copySourceFile copies file from the file cache to dest, holding the cache lock only while copying.
+func (w *Worker) copySourceFile(id build.ID, dest string) error {
+	path, unlock, err := w.fileCache.Get(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if err := EnsureBaseDir(dest); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, source)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// downloadArtifacts makes outputs of all deps available locally.
+//
+// Each dep is downloaded from the first of its sources that works. Deps listed in
+// build.Job.DepPaths, that are missing in the local cache, are downloaded partially into partialDir.
+func (w *Worker) downloadArtifacts(ctx context.Context, job *api.JobSpec, partialDir string) (map[build.ID]string, error) {
+	depsCtx := make(map[build.ID]string)
+	for id := range job.Artifacts {
+		if artPath, unlock, err := w.artifacts.Get(id); err == nil {
+			depsCtx[id] = artPath
 			unlock()
-			return err
+			continue
 		}
-		defer source.Close()
 
-		tmpFilename := filepath.Join(destDir, newFile)
-		err = EnsureBaseDir(tmpFilename)
-		if err != nil {
-			w.logger.Sugar().Infof(err.Error())
-			return err
+		var sources []string
+		for _, source := range job.ArtifactSources[id] {
+			sources = append(sources, source.String())
 		}
-		dest, innerErr := os.Create(tmpFilename)
-		err = innerErr
-		if err != nil {
-			unlock()
-			return err
+		if len(sources) == 0 && job.Artifacts[id] != "" {
+			sources = []string{job.Artifacts[id].String()}
 		}
-		defer dest.Close()
 
-		_, err = io.Copy(dest, source)
-		if err != nil {
-			unlock()
-			return err
+		paths, partial := job.DepPaths[id]
+		artPath := filepath.Join(partialDir, id.String())
+
+		var bad []string
+		var err error
+		if partial {
+			bad, err = artifact.Fallback(ctx, sources, func(source string) error {
+				return artifact.DownloadPaths(ctx, source, id, paths, artPath)
+			})
+		} else {
+			bad, err = w.downloads.Download(ctx, id, sources)
 		}
 
-		unlock()
-	}
-	return nil
-}
+		w.jobs.Lock()
+		for _, source := range bad {
+			w.jobs.badSources = append(w.jobs.badSources, api.ArtifactSource{ID: id, Worker: api.WorkerID(source)})
+		}
+		if err == nil && !partial {
+			w.jobs.addedArtifacts = append(w.jobs.addedArtifacts, id)
+		}
+		w.jobs.Unlock()
 
-func (w *Worker) downloadArtifacts(ctx context.Context, job *api.JobSpec) (map[build.ID]string, error) {
-	depsCtx := make(map[build.ID]string)
-	for id, remoteWorker := range job.Artifacts {
-		err := artifact.Download(ctx, remoteWorker.String(), w.artifacts, id)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("download artifact %s: %w", id, err)
 		}
 
-		artPath, unlock, innerErr := w.artifacts.Get(id)
-		err = innerErr
-		if err != nil {
-			return nil, err
+		if !partial {
+			var unlock func()
+			artPath, unlock, err = w.artifacts.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			unlock()
 		}
 		depsCtx[id] = artPath
-		unlock()
 	}
 
 	return depsCtx, nil
 }
 
+// infraFailure reports job that could not run because of the worker or its peers.
+func infraFailure(id build.ID, err error) api.JobResult {
+	errorText := err.Error()
+	return api.JobResult{ID: id, Error: &errorText, Retryable: true}
+}
+
+func (w *Worker) sandboxSpec(sourceDir, outputDir, tmpDir string, deps map[build.ID]string) *sandboxSpec {
+	if w.config.Sandbox == nil {
+		return nil
+	}
+
+	spec := &sandboxSpec{
+		Toolchain: w.config.Sandbox.ToolchainPaths,
+		ReadOnly:  []string{sourceDir},
+		Writable:  []string{outputDir, tmpDir},
+	}
+	for _, depDir := range deps {
+		spec.ReadOnly = append(spec.ReadOnly, depDir)
+	}
+	return spec
+}
+
+// defaultPath задаёт PATH команд, если у самого воркера PATH не выставлен.
+const defaultPath = "/usr/local/bin:/usr/bin:/bin"
+
+// jobEnviron returns environment of a job command.
+//
+// Commands do not inherit environment of the worker. They get PATH of the worker, HOME and TMPDIR
+// pointing to the scratch directory of the job, variables listed in Config.EnvPassthrough and,
+// finally, rendered Cmd.Environ, which overrides everything else.
+func (w *Worker) jobEnviron(tmpDir string, environ []string) []string {
+	pathEnv, ok := os.LookupEnv("PATH")
+	if !ok {
+		pathEnv = defaultPath
+	}
+
+	env := []string{"PATH=" + pathEnv, "HOME=" + tmpDir, "TMPDIR=" + tmpDir}
+	for _, name := range w.config.EnvPassthrough {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return append(env, environ...)
+}
+
+// workingDirectory resolves rendered Cmd.WorkingDirectory. Empty and relative paths
+// are resolved against the source directory of the job.
+func workingDirectory(sourceDir, dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(sourceDir, dir)
+}
+
+// freeSlots задаёт, сколько джобов воркер выполняет одновременно.
+const freeSlots = 1
+
 func (w *Worker) Run(ctx context.Context) error {
-	finished := make([]api.JobResult, 0)
-	addedArtifacts := make([]build.ID, 0)
+	if w.logs != nil && w.logs.temporary {
+		defer func() { _ = os.RemoveAll(w.logs.dir) }()
+	}
+	defer w.jobs.wg.Wait()
+
 	for {
+		w.jobs.Lock()
+		running := make([]build.ID, 0, len(w.jobs.running))
+		for id := range w.jobs.running {
+			running = append(running, id)
+		}
+
 		req := &api.HeartbeatRequest{
 			WorkerID:       w.workerID,
-			FreeSlots:      1,
-			FinishedJob:    finished,
-			AddedArtifacts: addedArtifacts,
+			RunningJobs:    running,
+			FreeSlots:      freeSlots - len(running),
+			TotalResources: w.config.Resources,
+			FreeResources:  w.freeResources(),
+			Labels:         w.config.Labels,
+			FinishedJob:    w.jobs.finished,
+			AddedArtifacts: w.jobs.addedArtifacts,
+			CanceledJobs:   w.jobs.canceled,
+			Output:         w.jobs.output,
+
+			BadArtifactSources: w.jobs.badSources,
 		}
 
-		finished = make([]api.JobResult, 0)
-		addedArtifacts = make([]build.ID, 0)
+		w.jobs.finished = make([]api.JobResult, 0)
+		w.jobs.addedArtifacts = make([]build.ID, 0)
+		w.jobs.canceled = nil
+		w.jobs.output = nil
+		w.jobs.badSources = nil
+		w.jobs.Unlock()
 
 		resp, err := w.heartbeatClient.Heartbeat(ctx, req)
 		if err != nil {
+			w.cancelAll()
 			return err
 		}
 
+		for _, id := range resp.JobsToCancel {
+			w.cancelJob(id)
+		}
+
 		for _, job := range resp.JobsToRun {
-			tmpDir, err := os.MkdirTemp("", "file"+job.ID.String())
-			if err != nil {
-				return err
-			}
+			w.startJob(ctx, job)
+		}
 
-			err = w.downloadSourceFiles(ctx, &job, tmpDir)
-			if err != nil {
-				return err
+		if req.FreeSlots > 0 && len(resp.JobsToRun) != 0 {
+			continue
+		}
+
+		select {
+		case <-w.jobs.done:
+		case <-time.After(HeartbeatInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// startJob runs the job in background. Its result is reported with the next heartbeat.
+func (w *Worker) startJob(ctx context.Context, job api.JobSpec) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	running := &runningJob{cancel: cancel, resources: job.Resources}
+
+	w.jobs.Lock()
+	w.jobs.running[job.ID] = running
+	w.jobs.Unlock()
+
+	w.jobs.wg.Add(1)
+	go func() {
+		defer w.jobs.wg.Done()
+		defer cancel()
+
+		res, added := w.runJob(jobCtx, &job)
+
+		w.jobs.Lock()
+		delete(w.jobs.running, job.ID)
+		switch {
+		case running.canceled:
+			// Отменённый джоб не сообщает результат: его уже получили с другой попытки или он больше не нужен.
+			w.jobs.canceled = append(w.jobs.canceled, job.ID)
+			if added {
+				w.jobs.addedArtifacts = append(w.jobs.addedArtifacts, job.ID)
 			}
-			
-			depsCtx, err := w.downloadArtifacts(ctx, &job)
-			if err != nil {
-				return err
+		case ctx.Err() == nil:
+			w.jobs.finished = append(w.jobs.finished, res)
+			if added {
+				w.jobs.addedArtifacts = append(w.jobs.addedArtifacts, job.ID)
 			}
+		}
+		w.jobs.Unlock()
 
-			outputDir, commit, abort, err := w.artifacts.Create(job.ID)
-			if err != nil {
-				return err
+		select {
+		case w.jobs.done <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// cancelJob kills processes of the running job. The job is acknowledged as canceled
+// in the next heartbeat after it stops.
+func (w *Worker) cancelJob(id build.ID) {
+	w.jobs.Lock()
+	defer w.jobs.Unlock()
+
+	running, ok := w.jobs.running[id]
+	if !ok {
+		// Джоб уже завершился, и его результат отправлен или будет отправлен координатору.
+		w.jobs.canceled = append(w.jobs.canceled, id)
+		return
+	}
+
+	w.logger.Info("canceling job", zap.String("job", id.String()))
+	running.canceled = true
+	running.cancel()
+}
+
+// jobOutput передаёт вывод команд джоба координатору со следующим heartbeat-ом.
+type jobOutput struct {
+	w      *Worker
+	id     build.ID
+	stderr bool
+}
+
+func (o *jobOutput) Write(p []byte) (int, error) {
+	o.w.jobs.Lock()
+	defer o.w.jobs.Unlock()
+
+	output := &o.w.jobs.output
+	if n := len(*output); n == 0 || (*output)[n-1].ID != o.id {
+		*output = append(*output, api.JobOutput{ID: o.id})
+	}
+
+	last := &(*output)[len(*output)-1]
+	if o.stderr {
+		last.Stderr = append(last.Stderr, p...)
+	} else {
+		last.Stdout = append(last.Stdout, p...)
+	}
+	return len(p), nil
+}
+
+func (w *Worker) cancelAll() {
+	w.jobs.Lock()
+	defer w.jobs.Unlock()
+
+	for _, running := range w.jobs.running {
+		running.cancel()
+	}
+}
+
+// runJob runs all commands of the job and reports whether its artifact was added to the cache.
+// If the artifact is already in the cache, the job is not run and is reported as succeeded.
+//
+// Any failure is reported in the result, so that a broken job does not stop the worker.
+func (w *Worker) runJob(ctx context.Context, job *api.JobSpec) (res api.JobResult, added bool) {
+	res.ID = job.ID
+	fail := func(err error) {
+		w.logger.Warn("job failed", zap.String("job", job.ID.String()), zap.Error(err))
+		errorText := err.Error()
+		res.Error = &errorText
+	}
+
+	sourceDir, err := os.MkdirTemp("", "file"+job.ID.String())
+	if err != nil {
+		return infraFailure(job.ID, err), false
+	}
+	defer func() { _ = os.RemoveAll(sourceDir) }()
+
+	tmpDir, err := os.MkdirTemp("", "tmp"+job.ID.String())
+	if err != nil {
+		return infraFailure(job.ID, err), false
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	partialDir, err := os.MkdirTemp("", "deps"+job.ID.String())
+	if err != nil {
+		return infraFailure(job.ID, err), false
+	}
+	defer func() { _ = os.RemoveAll(partialDir) }()
+
+	var depsCtx map[build.ID]string
+	err = w.downloadSourceFiles(ctx, job, sourceDir)
+	if err == nil {
+		depsCtx, err = w.downloadArtifacts(ctx, job, partialDir)
+	}
+	if err != nil {
+		w.logger.Warn("failed to download job inputs",
+			zap.String("job", job.ID.String()), zap.Error(err))
+		return infraFailure(job.ID, err), false
+	}
+
+	outputDir, commit, abort, err := w.artifacts.Create(job.ID)
+	if errors.Is(err, artifact.ErrExists) {
+		// Артефакт остался от прошлого запуска, о котором координатор не знает. Джоб детерминирован,
+		// поэтому достаточно сообщить, что артефакт есть на этом воркере.
+		w.logger.Info("job artifact is already cached", zap.String("job", job.ID.String()))
+		return res, true
+	} else if err != nil {
+		return infraFailure(job.ID, err), false
+	}
+
+	jobCtx, cancelJob := ctx, context.CancelFunc(func() {})
+	if job.Timeout > 0 {
+		jobCtx, cancelJob = context.WithTimeout(ctx, job.Timeout)
+	}
+	defer cancelJob()
+
+	cgroup, err := w.cgroups.create(job.ID, job.Resources)
+	if err != nil {
+		w.logger.Warn("failed to create job cgroup, running without resource limits",
+			zap.String("job", job.ID.String()), zap.Error(err))
+		cgroup = nil
+	}
+
+	newCapture := func(stream string, forward io.Writer) *outputCapture {
+		return &outputCapture{
+			logger:  w.logger,
+			store:   w.logs,
+			id:      job.ID,
+			stream:  stream,
+			limit:   w.config.MaxInlineOutput,
+			forward: forward,
+		}
+	}
+	stdout := newCapture("stdout", &jobOutput{w: w, id: job.ID})
+	stderr := newCapture("stderr", &jobOutput{w: w, id: job.ID, stderr: true})
+
+	var cmdStdout, cmdStderr io.Writer = stdout, stderr
+	var combined *combinedLog
+	if job.CombinedLog {
+		combined = newCombinedLog(w.config.MaxInlineOutput)
+		cmdStdout = io.MultiWriter(stdout, combined.stream("stdout"))
+		cmdStderr = io.MultiWriter(stderr, combined.stream("stderr"))
+	}
+
+	depAliases := job.DepKeys(job.DepNames)
+	numCPU := w.jobCPUs(job.Resources)
+
+	started := time.Now()
+	for i, initCmd := range job.Cmds {
+		renderCtx := build.JobContext{
+			SourceDir:  sourceDir,
+			OutputDir:  outputDir,
+			TmpDir:     tmpDir,
+			JobID:      job.ID,
+			WorkerID:   w.workerID.String(),
+			NumCPU:     numCPU,
+			Inputs:     job.Inputs,
+			Deps:       depsCtx,
+			DepAliases: depAliases,
+		}
+
+		rendered, err := initCmd.Render(renderCtx)
+		if err != nil {
+			fail(fmt.Errorf("render cmd %d: %w", i, err))
+			break
+		}
+
+		if len(rendered.Exec) == 0 {
+			if err := w.runFileOp(jobCtx, rendered, sourceDir, outputDir, tmpDir, depsCtx); err != nil {
+				fail(fmt.Errorf("run cmd %d: %w", i, err))
+				break
 			}
+			continue
+		}
+
+		cmdCtx, cancel := jobCtx, context.CancelFunc(func() {})
+		if rendered.Timeout > 0 {
+			cmdCtx, cancel = context.WithTimeout(jobCtx, rendered.Timeout)
+		}
+
+		out, err := runExec(cmdCtx, &execOptions{
+			Argv:    rendered.Exec,
+			Env:     w.jobEnviron(tmpDir, rendered.Environ),
+			Dir:     workingDirectory(sourceDir, rendered.WorkingDirectory),
+			Sandbox: w.sandboxSpec(sourceDir, outputDir, tmpDir, depsCtx),
+			Cgroup:  cgroup,
+			Stdout:  cmdStdout,
+			Stderr:  cmdStderr,
+		})
+		cancel()
+		if combined != nil {
+			combined.endCommand()
+		}
+		if err != nil {
+			fail(fmt.Errorf("run cmd %d: %w", i, err))
+			break
+		}
 
-			res := api.JobResult{}
-			for _, initCmd := range job.Cmds {
-				jobCtx := build.JobContext{
-					SourceDir: tmpDir,
-					OutputDir: outputDir,
-					Deps:      depsCtx,
-				}
-
-				rendered, innerErr := initCmd.Render(jobCtx)
-				err = innerErr
-				if err != nil {
-					_ = abort()
-					return err
-				}
-
-				isCat := false
-				if rendered.Exec == nil {
-					rendered.Exec = make([]string, 0)
-					rendered.Exec = append(rendered.Exec, "bash", "-c")
-					rendered.Exec = append(rendered.Exec, "echo -n "+rendered.CatTemplate+" > "+rendered.CatOutput)
-					isCat = true
-				}
-
-				cmd := exec.Command(rendered.Exec[0], rendered.Exec[1:]...)
-				cmd.Env = append(cmd.Env, initCmd.Environ...)
-				cmd.Dir = initCmd.WorkingDirectory
-
-				res.ID = job.ID
-				stdoutPipe, innerErr := cmd.StdoutPipe()
-				err = innerErr
-				if err != nil {
-					_ = abort()
-					return err
-				}
-
-				stderrPipe, innerErr := cmd.StderrPipe()
-				err = innerErr
-				if err != nil {
-					_ = abort()
-					return err
-				}
-
-				err = cmd.Start()
-				if err != nil {
-					_ = abort()
-					return err
-				}
-
-				if !isCat {
-					cmdStdout, innErr := io.ReadAll(stdoutPipe)
-					err = innErr
-					if err != nil {
-						_ = abort()
-						return err
-					}
-					res.Stdout = append(res.Stdout, cmdStdout...)
-				}
-
-				cmdStderr, innerErr := io.ReadAll(stderrPipe)
-				err = innerErr
-				if err != nil {
-					_ = abort()
-					return err
-				}
-				res.Stderr = append(res.Stderr, cmdStderr...)
+		res.ExitCode = out.ExitCode
+		res.Usage.CPUTime += out.Usage.CPUTime
+		if out.Usage.PeakRSS > res.Usage.PeakRSS {
+			res.Usage.PeakRSS = out.Usage.PeakRSS
+		}
+
+		if out.TimedOut {
+			errorText := fmt.Sprintf("cmd %d timed out after %s", i, rendered.Timeout)
+			if jobCtx.Err() != nil {
+				errorText = fmt.Sprintf("job timed out after %s", job.Timeout)
 			}
+			res.Error = &errorText
+			res.TimedOut = true
+			break
+		}
+
+		if res.ExitCode != 0 {
+			break
+		}
+	}
+
+	res.Usage.WallTime = time.Since(started)
+	res.Stdout, res.StdoutLog = stdout.finish(w.workerID)
+	res.Stderr, res.StderrLog = stderr.finish(w.workerID)
+	if combined != nil {
+		res.Log, res.LogTruncated = combined.finish()
+	}
+
+	if cgroup != nil {
+		usage := cgroup.usage()
+		if usage.CPUTime != 0 {
+			res.Usage.CPUTime = usage.CPUTime
+		}
+		if usage.PeakRSS != 0 {
+			res.Usage.PeakRSS = usage.PeakRSS
+		}
 
-			_ = commit()
-			finished = append(finished, res)
-			addedArtifacts = append(addedArtifacts, job.ID)
+		if cgroup.oomKilled() && res.Error == nil {
+			errorText := fmt.Sprintf("job exceeded memory limit of %d bytes", job.Resources.Memory)
+			res.Error = &errorText
 		}
+
+		if err := cgroup.remove(); err != nil {
+			w.logger.Warn("failed to remove job cgroup", zap.Error(err))
+		}
+	}
+
+	if res.Error == nil && res.ExitCode == 0 {
+		undeclared, err := job.CheckOutputs(outputDir)
+		if err != nil {
+			fail(err)
+		} else if len(undeclared) != 0 {
+			w.logger.Warn("job produced undeclared outputs",
+				zap.String("job", job.ID.String()), zap.Strings("outputs", undeclared))
+			res.UndeclaredOutputs = undeclared
+		}
+	}
+
+	if res.Error != nil || res.ExitCode != 0 {
+		_ = abort()
+		return res, false
+	}
+
+	if err := commit(); err != nil {
+		_ = os.RemoveAll(outputDir)
+		return infraFailure(job.ID, err), false
 	}
+	return res, true
 }